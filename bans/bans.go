@@ -0,0 +1,196 @@
+// Package bans keeps the list of IP addresses, IP ranges, accounts and issuers
+// that are banned from uploading, stored in the bans database table.
+package bans
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/kiwiirc/plugin-fileuploader/db"
+)
+
+// ErrNotFound is returned when removing a ban that does not exist
+var ErrNotFound = errors.New("ban not found")
+
+// Ban is a single ban entry. Entries with an IPRange ban an IP address or
+// range, entries with an Account ban that account of the Issuer, and entries
+// with only an Issuer ban every account of that issuer.
+type Ban struct {
+	ID        string `db:"id" json:"id"`
+	IPRange   string `db:"ip_range" json:"ip_range,omitempty"`
+	Account   string `db:"jwt_account" json:"account,omitempty"`
+	Issuer    string `db:"jwt_issuer" json:"issuer,omitempty"`
+	Reason    string `db:"reason" json:"reason"`
+	CreatedBy string `db:"created_by" json:"created_by"`
+	CreatedAt int64  `db:"created_at" json:"created_at"`
+	ExpiresAt *int64 `db:"expires_at" json:"expires_at,omitempty"`
+
+	ipNet *net.IPNet
+}
+
+// Expired reports whether the ban has expired
+func (ban *Ban) Expired(now time.Time) bool {
+	return ban.ExpiresAt != nil && *ban.ExpiresAt <= now.Unix()
+}
+
+// IPNet returns the banned IP range, or nil for account and issuer bans
+func (ban *Ban) IPNet() *net.IPNet {
+	if ban.ipNet == nil && ban.IPRange != "" {
+		_, ban.ipNet, _ = net.ParseCIDR(ban.IPRange)
+	}
+	return ban.ipNet
+}
+
+// matches reports whether a request from ip, by account of issuer, is banned
+func (ban *Ban) matches(ip net.IP, account, issuer string) bool {
+	switch {
+	case ban.IPRange != "":
+		ipNet := ban.IPNet()
+		return ip != nil && ipNet != nil && ipNet.Contains(ip)
+	case ban.Account != "":
+		return ban.Account == account && ban.Issuer == issuer
+	default:
+		return issuer != "" && ban.Issuer == issuer
+	}
+}
+
+// List caches the active bans, reloading them from the database at most once
+// per refresh interval so that changes made by other instances are picked up
+type List struct {
+	dbConn   *db.DatabaseConnection
+	refresh  time.Duration
+	mu       sync.Mutex
+	active   []Ban
+	loadedAt time.Time
+}
+
+// New creates a ban list backed by the bans table
+func New(dbConn *db.DatabaseConnection, refresh time.Duration) *List {
+	return &List{
+		dbConn:  dbConn,
+		refresh: refresh,
+	}
+}
+
+// Match returns the ban covering a request from ip, by account of issuer.
+// account and issuer are empty for anonymous requests.
+func (list *List) Match(ip, account, issuer string) (*Ban, error) {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	now := time.Now()
+	if list.active == nil || now.Sub(list.loadedAt) >= list.refresh {
+		err := list.load(now)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	parsedIP := net.ParseIP(ip)
+	for i := range list.active {
+		ban := &list.active[i]
+		if !ban.Expired(now) && ban.matches(parsedIP, account, issuer) {
+			return ban, nil
+		}
+	}
+	return nil, nil
+}
+
+// load replaces the cached bans with the unexpired bans in the database
+func (list *List) load(now time.Time) error {
+	active := make([]Ban, 0)
+	err := list.dbConn.DB.Select(&active, list.dbConn.DB.Rebind(`
+		SELECT id, ip_range, jwt_account, jwt_issuer, reason, created_by, created_at, expires_at
+		FROM bans
+		WHERE expires_at IS NULL OR expires_at > ?
+	`), now.Unix())
+	if err != nil {
+		return err
+	}
+
+	list.active = active
+	list.loadedAt = now
+	return nil
+}
+
+// All returns every ban, including expired ones, newest first
+func (list *List) All() ([]Ban, error) {
+	all := make([]Ban, 0)
+	err := list.dbConn.DB.Select(&all, `
+		SELECT id, ip_range, jwt_account, jwt_issuer, reason, created_by, created_at, expires_at
+		FROM bans
+		ORDER BY created_at DESC
+	`)
+	return all, err
+}
+
+// Add stores a ban, which must have its ID set. An IPRange holding a single
+// address is stored as a CIDR range covering just that address.
+func (list *List) Add(ban *Ban) error {
+	if ban.IPRange != "" {
+		ipNet, err := ParseIPRange(ban.IPRange)
+		if err != nil {
+			return err
+		}
+		ban.IPRange = ipNet.String()
+		ban.ipNet = ipNet
+	} else if ban.Issuer == "" {
+		return errors.New("A ban needs an IP address, range, account or issuer")
+	}
+
+	_, err := list.dbConn.DB.NamedExec(`
+		INSERT INTO bans(id, ip_range, jwt_account, jwt_issuer, reason, created_by, created_at, expires_at)
+		VALUES (:id, :ip_range, :jwt_account, :jwt_issuer, :reason, :created_by, :created_at, :expires_at)
+	`, ban)
+	if err != nil {
+		return err
+	}
+
+	list.invalidate()
+	return nil
+}
+
+// Remove deletes a ban
+func (list *List) Remove(id string) error {
+	res, err := list.dbConn.DB.Exec(list.dbConn.DB.Rebind(`DELETE FROM bans WHERE id = ?`), id)
+	if err != nil {
+		return err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotFound
+	}
+
+	list.invalidate()
+	return nil
+}
+
+// invalidate makes the next Match reload the bans
+func (list *List) invalidate() {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	list.active = nil
+}
+
+// ParseIPRange parses an IP address or CIDR range
+func ParseIPRange(str string) (*net.IPNet, error) {
+	if _, ipNet, err := net.ParseCIDR(str); err == nil {
+		return ipNet, nil
+	}
+
+	ip := net.ParseIP(str)
+	if ip == nil {
+		return nil, errors.New("Invalid IP address or range")
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 8 * net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
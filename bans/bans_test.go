@@ -0,0 +1,81 @@
+package bans
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseIPRange(t *testing.T) {
+	tests := []struct {
+		str     string
+		want    string
+		wantErr bool
+	}{
+		{"192.0.2.1", "192.0.2.1/32", false},
+		{"192.0.2.0/24", "192.0.2.0/24", false},
+		{"192.0.2.77/24", "192.0.2.0/24", false},
+		{"2001:db8::1", "2001:db8::1/128", false},
+		{"2001:db8::/32", "2001:db8::/32", false},
+		{"::ffff:192.0.2.1", "192.0.2.1/32", false},
+		{"", "", true},
+		{"example.com", "", true},
+		{"192.0.2.0/33", "", true},
+		{"192.0.2.256", "", true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseIPRange(test.str)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParseIPRange(%q) error = %v, want error %v", test.str, err, test.wantErr)
+			continue
+		}
+		if !test.wantErr && got.String() != test.want {
+			t.Errorf("ParseIPRange(%q) = %s, want %s", test.str, got, test.want)
+		}
+	}
+}
+
+func TestBanMatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		ban     Ban
+		ip      string
+		account string
+		issuer  string
+		want    bool
+	}{
+		{"address in range", Ban{IPRange: "192.0.2.0/24"}, "192.0.2.10", "", "", true},
+		{"address outside range", Ban{IPRange: "192.0.2.0/24"}, "198.51.100.1", "", "", false},
+		{"single address", Ban{IPRange: "2001:db8::1/128"}, "2001:db8::1", "", "", true},
+		{"no address", Ban{IPRange: "192.0.2.0/24"}, "", "", "", false},
+		{"account", Ban{Account: "alice", Issuer: "irc"}, "192.0.2.1", "alice", "irc", true},
+		{"account of another issuer", Ban{Account: "alice", Issuer: "irc"}, "192.0.2.1", "alice", "other", false},
+		{"issuer", Ban{Issuer: "irc"}, "192.0.2.1", "bob", "irc", true},
+		{"anonymous under issuer ban", Ban{Issuer: "irc"}, "192.0.2.1", "", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.ban.matches(net.ParseIP(test.ip), test.account, test.issuer); got != test.want {
+				t.Errorf("matches() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBanExpired(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Minute).Unix()
+	future := now.Add(time.Minute).Unix()
+
+	if (&Ban{}).Expired(now) {
+		t.Error("ban without expiry has expired")
+	}
+	if !(&Ban{ExpiresAt: &past}).Expired(now) {
+		t.Error("ban expiring in the past has not expired")
+	}
+	if (&Ban{ExpiresAt: &future}).Expired(now) {
+		t.Error("ban expiring in the future has expired")
+	}
+}
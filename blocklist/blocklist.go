@@ -0,0 +1,138 @@
+// Package blocklist holds the hashes of known bad files, loaded from hash list
+// files and the blocklist database table, that uploads are checked against.
+package blocklist
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kiwiirc/plugin-fileuploader/db"
+)
+
+// Blocklist is a set of blocked SHA-256 hashes with the reason each was blocked.
+// A nil Blocklist blocks nothing.
+type Blocklist struct {
+	sha256 map[string]string
+}
+
+// Load reads the given hash list files, and the blocklist database table if
+// dbConn is not nil. Each line of a file holds a hex encoded hash, optionally
+// followed by whitespace and a reason. Empty lines and lines starting with #
+// are ignored. Nothing is returned when a file or the table can't be read, or
+// holds an invalid hash.
+func Load(files []string, dbConn *db.DatabaseConnection) (*Blocklist, error) {
+	blocklist := &Blocklist{
+		sha256: make(map[string]string),
+	}
+
+	for _, path := range files {
+		err := blocklist.loadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if dbConn != nil {
+		err := blocklist.loadTable(dbConn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return blocklist, nil
+}
+
+func (blocklist *Blocklist) loadFile(path string) error {
+	return readHashFile(path, func(hash, reason string) error {
+		hash = strings.ToLower(hash)
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != 64 {
+			return fmt.Errorf("invalid sha256 hash %#v", hash)
+		}
+		blocklist.sha256[hash] = reason
+		return nil
+	})
+}
+
+// readHashFile calls add for each hash in a hash list file, with the reason
+// following it or the file path if there is none
+func readHashFile(path string, add func(hash, reason string) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		reason := path
+		if len(fields) > 1 {
+			reason = strings.Join(fields[1:], " ")
+		}
+
+		if err := add(fields[0], reason); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (blocklist *Blocklist) loadTable(dbConn *db.DatabaseConnection) error {
+	rows, err := dbConn.DB.Query(`SELECT sha256sum, reason FROM blocklist`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash, reason string
+		if err := rows.Scan(&hash, &reason); err != nil {
+			return err
+		}
+		blocklist.sha256[strings.ToLower(hash)] = reason
+	}
+
+	return rows.Err()
+}
+
+// MatchSHA256 returns the reason a hash was blocked, if it is in the blocklist
+func (blocklist *Blocklist) MatchSHA256(hash []byte) (reason string, blocked bool) {
+	if blocklist == nil {
+		return "", false
+	}
+	reason, blocked = blocklist.sha256[hex.EncodeToString(hash)]
+	return
+}
+
+// SHA256Hashes returns every blocked hash
+func (blocklist *Blocklist) SHA256Hashes() [][]byte {
+	if blocklist == nil {
+		return nil
+	}
+
+	hashes := make([][]byte, 0, len(blocklist.sha256))
+	for hash := range blocklist.sha256 {
+		hashBytes, _ := hex.DecodeString(hash)
+		hashes = append(hashes, hashBytes)
+	}
+	return hashes
+}
+
+// Len returns the number of blocked hashes
+func (blocklist *Blocklist) Len() int {
+	if blocklist == nil {
+		return 0
+	}
+	return len(blocklist.sha256)
+}
@@ -0,0 +1,90 @@
+package blocklist
+
+import (
+	"github.com/kiwiirc/plugin-fileuploader/db"
+	"github.com/kiwiirc/plugin-fileuploader/imagehash"
+)
+
+// PerceptualBlocklist is a list of perceptual image hashes, matched within a
+// Hamming distance so re-encoded copies of an image are still caught.
+// A nil PerceptualBlocklist blocks nothing.
+type PerceptualBlocklist struct {
+	entries []perceptualEntry
+}
+
+type perceptualEntry struct {
+	hash   uint64
+	reason string
+}
+
+// LoadPerceptual reads the given hash list files, and the phash_blocklist
+// database table if dbConn is not nil. Files use the same format as Load, with
+// hashes encoded as 16 hex characters. Nothing is returned on errors, as with
+// Load.
+func LoadPerceptual(files []string, dbConn *db.DatabaseConnection) (*PerceptualBlocklist, error) {
+	blocklist := &PerceptualBlocklist{}
+
+	for _, path := range files {
+		err := readHashFile(path, blocklist.add)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if dbConn != nil {
+		rows, err := dbConn.DB.Query(`SELECT phash, reason FROM phash_blocklist`)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var hash, reason string
+			if err := rows.Scan(&hash, &reason); err != nil {
+				return nil, err
+			}
+			if err := blocklist.add(hash, reason); err != nil {
+				return nil, err
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return blocklist, nil
+}
+
+func (blocklist *PerceptualBlocklist) add(hashStr, reason string) error {
+	hash, err := imagehash.Parse(hashStr)
+	if err != nil {
+		return err
+	}
+	blocklist.entries = append(blocklist.entries, perceptualEntry{hash, reason})
+	return nil
+}
+
+// Match returns the reason and distance of the closest blocked hash within
+// threshold bits of hash, if there is one
+func (blocklist *PerceptualBlocklist) Match(hash uint64, threshold int) (reason string, distance int, blocked bool) {
+	if blocklist == nil {
+		return "", 0, false
+	}
+
+	distance = threshold + 1
+	for _, entry := range blocklist.entries {
+		if d := imagehash.Distance(hash, entry.hash); d < distance {
+			distance = d
+			reason = entry.reason
+		}
+	}
+	return reason, distance, distance <= threshold
+}
+
+// Len returns the number of blocked hashes
+func (blocklist *PerceptualBlocklist) Len() int {
+	if blocklist == nil {
+		return 0
+	}
+	return len(blocklist.entries)
+}
@@ -0,0 +1,132 @@
+// Package clamav scans files for viruses by streaming them to a clamd daemon
+// with the INSTREAM command.
+package clamav
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// chunkSize is the size of the chunks a file is streamed to clamd in
+const chunkSize = 64 * 1024
+
+// ErrSizeLimit is returned when a file is larger than clamd's StreamMaxLength
+var ErrSizeLimit = errors.New("file exceeds the clamd stream size limit")
+
+// Client connects to a clamd daemon
+type Client struct {
+	Network string        // "tcp" or "unix"
+	Address string        // host:port or socket path
+	Timeout time.Duration // Limit on the time taken by a whole scan
+}
+
+// Result is the outcome of a scan
+type Result struct {
+	Infected  bool
+	Signature string // Name of the detected virus
+}
+
+// New creates a client from an address of the form tcp://host:port or
+// unix:///path/to/clamd.ctl
+func New(address string, timeout time.Duration) (*Client, error) {
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+
+	switch parsed.Scheme {
+	case "tcp":
+		return &Client{Network: "tcp", Address: parsed.Host, Timeout: timeout}, nil
+	case "unix":
+		return &Client{Network: "unix", Address: parsed.Path, Timeout: timeout}, nil
+	default:
+		return nil, fmt.Errorf("unsupported clamd address %#v", address)
+	}
+}
+
+// ScanFile scans the file at path
+func (client *Client) ScanFile(path string) (Result, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Result{}, err
+	}
+	defer file.Close()
+
+	return client.Scan(file)
+}
+
+// Scan streams the content of r to clamd and returns its verdict
+func (client *Client) Scan(r io.Reader) (Result, error) {
+	conn, err := net.DialTimeout(client.Network, client.Address, client.Timeout)
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+
+	if client.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(client.Timeout))
+	}
+
+	// the z prefix makes clamd use null terminated commands and replies
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return Result{}, err
+	}
+
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, readErr := r.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				// clamd closes the connection once the size limit is reached,
+				// its reply explains why
+				break
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return Result{}, readErr
+		}
+	}
+
+	// a zero length chunk ends the stream
+	conn.Write([]byte{0, 0, 0, 0})
+
+	reply, err := ioutil.ReadAll(conn)
+	if err != nil && len(reply) == 0 {
+		return Result{}, err
+	}
+
+	return parseReply(string(bytes.TrimRight(reply, "\x00\n")))
+}
+
+// parseReply interprets replies such as "stream: OK" and
+// "stream: Eicar-Signature FOUND"
+func parseReply(reply string) (Result, error) {
+	status := strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case status == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(status, " FOUND"):
+		return Result{
+			Infected:  true,
+			Signature: strings.TrimSuffix(status, " FOUND"),
+		}, nil
+	case strings.Contains(status, "size limit exceeded"):
+		return Result{}, ErrSizeLimit
+	default:
+		return Result{}, fmt.Errorf("unexpected clamd reply %#v", reply)
+	}
+}
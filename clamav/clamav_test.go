@@ -0,0 +1,122 @@
+package clamav
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseReply(t *testing.T) {
+	tests := []struct {
+		reply   string
+		want    Result
+		wantErr error
+	}{
+		{"stream: OK", Result{}, nil},
+		{"stream: Eicar-Test-Signature FOUND", Result{Infected: true, Signature: "Eicar-Test-Signature"}, nil},
+		{"stream: Win.Test.EICAR_HDB-1 FOUND", Result{Infected: true, Signature: "Win.Test.EICAR_HDB-1"}, nil},
+		{"INSTREAM size limit exceeded. ERROR", Result{}, ErrSizeLimit},
+	}
+
+	for _, test := range tests {
+		got, err := parseReply(test.reply)
+		if err != test.wantErr {
+			t.Errorf("parseReply(%q) error = %v, want %v", test.reply, err, test.wantErr)
+		}
+		if got != test.want {
+			t.Errorf("parseReply(%q) = %+v, want %+v", test.reply, got, test.want)
+		}
+	}
+
+	for _, reply := range []string{"", "stream: ERROR", "UNKNOWN COMMAND"} {
+		if _, err := parseReply(reply); err == nil || err == ErrSizeLimit {
+			t.Errorf("parseReply(%q) error = %v, want an unexpected reply error", reply, err)
+		}
+	}
+}
+
+// fakeClamd accepts one INSTREAM scan, returning the streamed content on
+// received and answering with reply
+func fakeClamd(t *testing.T, reply string, received chan<- []byte) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		command := make([]byte, len("zINSTREAM\x00"))
+		if _, err := io.ReadFull(conn, command); err != nil {
+			return
+		}
+
+		var content bytes.Buffer
+		for {
+			var size uint32
+			if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+				return
+			}
+			if size == 0 {
+				break
+			}
+			if _, err := io.CopyN(&content, conn, int64(size)); err != nil {
+				return
+			}
+		}
+		received <- content.Bytes()
+
+		conn.Write([]byte(reply + "\x00"))
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestScan(t *testing.T) {
+	content := strings.Repeat("x", chunkSize+10)
+	received := make(chan []byte, 1)
+	client := &Client{Network: "tcp", Address: fakeClamd(t, "stream: OK", received)}
+
+	result, err := client.Scan(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Infected {
+		t.Error("clean content reported as infected")
+	}
+	if got := <-received; string(got) != content {
+		t.Errorf("clamd received %d bytes, want %d", len(got), len(content))
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		address     string
+		wantNetwork string
+		wantAddress string
+		wantErr     bool
+	}{
+		{"tcp://127.0.0.1:3310", "tcp", "127.0.0.1:3310", false},
+		{"unix:///var/run/clamav/clamd.ctl", "unix", "/var/run/clamav/clamd.ctl", false},
+		{"http://127.0.0.1:3310", "", "", true},
+	}
+
+	for _, test := range tests {
+		client, err := New(test.address, 0)
+		if (err != nil) != test.wantErr {
+			t.Errorf("New(%q) error = %v, want error %v", test.address, err, test.wantErr)
+			continue
+		}
+		if !test.wantErr && (client.Network != test.wantNetwork || client.Address != test.wantAddress) {
+			t.Errorf("New(%q) = %s %s, want %s %s", test.address, client.Network, client.Address, test.wantNetwork, test.wantAddress)
+		}
+	}
+}
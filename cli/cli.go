@@ -0,0 +1,217 @@
+// Package cli implements the offline admin subcommands, which work directly on
+// the storage and database of a config without starting the HTTP server.
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"github.com/kiwiirc/plugin-fileuploader/config"
+	"github.com/kiwiirc/plugin-fileuploader/db"
+	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
+)
+
+type command struct {
+	args    string // usage of the arguments after the command name
+	summary string
+	run     func(env *env, args []string) error
+}
+
+var commands = map[string]command{
+	"list":       {"[--ip <ip|cidr>] [--account <account>] [--issuer <issuer>] [--type <pattern>] [--min-size <size>] [--largest] [--deleted] [--limit <n>]", "List uploads, newest first", runList},
+	"show":       {"<id>", "Show an upload and the abuse reports about it", runShow},
+	"rm":         {"<id>... | --ip <ip|cidr> | --account <account> --issuer <issuer> [--dry-run]", "Delete uploads", runRm},
+	"expire-now": {"[<id>...]", "Expire the given uploads and run an expiry cycle immediately", runExpireNow},
+	"stats":      {"", "Show upload and storage statistics", runStats},
+	"fsck":       {"[--repair] [--quick]", "Check that the database and the files in storage agree", runFsck},
+	"reshard":    {"", "Move the files in storage to the layout in the config", runReshard},
+	"export":     {"[--output <file>]", "Write every database row to a JSON lines file", runExport},
+	"import":     {"<file>", "Read an export into an empty database", runImport},
+	"copy":       {"--type <type> --path <path>", "Copy the database to another, empty database", runCopy},
+	"metadata":   {"import | export", "Move upload metadata between .info files and the database", runMetadata},
+	"migrate":    {"status | up [--limit <n>] | down [--limit <n>] | plan [up|down] [--limit <n>]", "Show, apply or revert database schema migrations", runMigrate},
+}
+
+// env holds what the commands work on, opened when first needed
+type env struct {
+	name   string // command being run
+	usage  string // usage of its arguments
+	cfg    *config.Config
+	layout shardedfilestore.Layout
+	log    *zerolog.Logger
+	out    io.Writer
+	json   bool
+	dbConn *db.DatabaseConnection
+	store  *shardedfilestore.ShardedFileStore
+}
+
+// Run runs the subcommand named by args[0] and returns the exit status
+func Run(configPath string, args []string) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		printUsage(os.Stderr)
+		return 2
+	}
+
+	// commands log to stderr so their output can be piped
+	log := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr, NoColor: true}).
+		Level(zerolog.InfoLevel).
+		With().Timestamp().Logger()
+
+	cfg := config.NewConfig()
+	if _, err := cfg.Load(&log, configPath); err != nil {
+		log.Error().Err(err).Str("path", configPath).Msg("Failed to load config")
+		return 1
+	}
+
+	layout := shardedfilestore.Layout{Depth: cfg.Storage.ShardLayers, Width: cfg.Storage.ShardWidth}
+	if args[0] != "reshard" {
+		if err := shardedfilestore.CheckLayout(cfg.Storage.Path, layout); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", args[0], err)
+			return 1
+		}
+	}
+
+	env := &env{
+		name:   args[0],
+		usage:  cmd.args,
+		cfg:    cfg,
+		layout: layout,
+		log:    &log,
+		out:    os.Stdout,
+	}
+	defer env.close()
+
+	err := cmd.run(env, args[1:])
+	if err == flag.ErrHelp {
+		return 2
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func printUsage(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "Usage: %s [-config <path>] <command> [--json] [args]\n\nCommands:\n", os.Args[0])
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-12s %s\n", name, commands[name].summary)
+	}
+}
+
+// parseFlags parses the flags of a command, which can be mixed with its
+// positional arguments, and adds the --json flag shared by every command
+func (env *env) parseFlags(flags *flag.FlagSet, args []string) ([]string, error) {
+	flags.BoolVar(&env.json, "json", false, "print JSON for scripting")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s %s\n", os.Args[0], env.name, env.usage)
+		flags.PrintDefaults()
+	}
+
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		if flags.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+// openStore connects to the database and opens the storage, after making
+// sure that the database schema is up to date
+func (env *env) openStore() (*shardedfilestore.ShardedFileStore, error) {
+	if env.store != nil {
+		return env.store, nil
+	}
+
+	store := env.connectStore()
+	if err := store.CheckSchema(env.cfg.Database.AutoMigrate); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// connectStore connects to the database and opens the storage, leaving the
+// database schema as it is
+func (env *env) connectStore() *shardedfilestore.ShardedFileStore {
+	if env.store != nil {
+		return env.store
+	}
+
+	env.dbConn = db.ConnectToDB(env.log, db.DBConfig{
+		DriverName: env.cfg.Database.Type,
+		DSN:        env.cfg.Database.Path,
+	})
+
+	env.store = shardedfilestore.New(
+		env.cfg.Storage.Path,
+		env.layout,
+		env.cfg.Expiration.MaxAge.Duration,
+		env.cfg.Expiration.IdentifiedMaxAge.Duration,
+		env.cfg.Expiration.TrashRetention.Duration,
+		env.cfg.Expiration.SlidingStep.Duration,
+		env.cfg.Expiration.SlidingMaxAge.Duration,
+		env.cfg.Downloads.StatsFlushInterval.Duration,
+		env.cfg.PreFinishCommands,
+		env.dbConn,
+		env.log,
+	)
+	env.store.MetadataInDatabase = env.cfg.Storage.MetadataInDatabase
+	return env.store
+}
+
+func (env *env) close() {
+	if env.store != nil {
+		env.store.Close()
+	}
+	if env.dbConn != nil {
+		env.dbConn.DB.Close()
+	}
+}
+
+// print writes v as JSON when --json was given, otherwise calls human to
+// write it in a readable form
+func (env *env) print(v interface{}, human func(w io.Writer)) error {
+	if env.json {
+		encoder := json.NewEncoder(env.out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+	human(env.out)
+	return nil
+}
+
+// errUsage is returned for invalid arguments, after printing the usage
+func errUsage(flags *flag.FlagSet, message string) error {
+	fmt.Fprintln(flags.Output(), message)
+	flags.Usage()
+	return flag.ErrHelp
+}
+
+// joinNonEmpty joins the non-empty strings with sep
+func joinNonEmpty(sep string, strs ...string) string {
+	nonEmpty := make([]string, 0, len(strs))
+	for _, str := range strs {
+		if str != "" {
+			nonEmpty = append(nonEmpty, str)
+		}
+	}
+	return strings.Join(nonEmpty, sep)
+}
@@ -0,0 +1,139 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/kiwiirc/plugin-fileuploader/db"
+	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
+)
+
+func runExport(env *env, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	output := flags.String("output", "", "file to write, instead of stdout")
+	positional, err := env.parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 0 {
+		return errUsage(flags, "Unexpected arguments")
+	}
+
+	w := env.out
+	var file *os.File
+	if *output != "" {
+		file, err = os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	} else {
+		// the export goes to stdout, so the summary can't
+		env.out = os.Stderr
+	}
+
+	store, err := env.openStore()
+	if err != nil {
+		return err
+	}
+	summaries, err := store.Export(w)
+	if err != nil {
+		return err
+	}
+	if file != nil {
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+
+	return env.print(summaries, func(w io.Writer) {
+		fmt.Fprintln(w, "Exported")
+		printSummaries(w, summaries)
+	})
+}
+
+func runImport(env *env, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	positional, err := env.parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errUsage(flags, "Expected one export file, or - for stdin")
+	}
+
+	var r io.Reader = os.Stdin
+	if positional[0] != "-" {
+		file, err := os.Open(positional[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	store, err := env.openStore()
+	if err != nil {
+		return err
+	}
+	summaries, err := store.Import(r)
+	if err != nil {
+		return err
+	}
+
+	return env.print(summaries, func(w io.Writer) {
+		fmt.Fprintln(w, "Imported and verified")
+		printSummaries(w, summaries)
+	})
+}
+
+func runCopy(env *env, args []string) error {
+	flags := flag.NewFlagSet("copy", flag.ContinueOnError)
+	var target db.DBConfig
+	flags.StringVar(&target.DriverName, "type", "", "type of the target database, like Database.Type")
+	flags.StringVar(&target.DSN, "path", "", "path of the target database, like Database.Path")
+	positional, err := env.parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 0 {
+		return errUsage(flags, "Unexpected arguments")
+	}
+	if target.DriverName == "" || target.DSN == "" {
+		return errUsage(flags, "--type and --path are required")
+	}
+	if target.DriverName == env.cfg.Database.Type && target.DSN == env.cfg.Database.Path {
+		return errUsage(flags, "The target database is the configured database")
+	}
+
+	store, err := env.openStore()
+	if err != nil {
+		return err
+	}
+	targetConn := db.ConnectToDB(env.log, target)
+	defer targetConn.DB.Close()
+
+	summaries, err := store.CopyTo(targetConn)
+	if err != nil {
+		return err
+	}
+
+	return env.print(summaries, func(w io.Writer) {
+		fmt.Fprintln(w, "Copied and verified")
+		printSummaries(w, summaries)
+	})
+}
+
+func printSummaries(w io.Writer, summaries map[string]shardedfilestore.TableSummary) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TABLE\tROWS\tSHA-256")
+	for _, table := range shardedfilestore.ExportTableNames() {
+		summary := summaries[table]
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", table, summary.Rows, summary.SHA256)
+	}
+	tw.Flush()
+}
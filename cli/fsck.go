@@ -0,0 +1,61 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
+)
+
+func runFsck(env *env, args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	var options shardedfilestore.FsckOptions
+	flags.BoolVar(&options.Repair, "repair", false, "fix the problems found")
+	quick := flags.Bool("quick", false, "don't hash the content of every blob")
+	positional, err := env.parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 0 {
+		return errUsage(flags, "Unexpected arguments")
+	}
+	options.VerifyHashes = !*quick
+
+	store, err := env.openStore()
+	if err != nil {
+		return err
+	}
+	report, err := store.Fsck(options)
+	if err != nil {
+		return err
+	}
+
+	err = env.print(report, func(w io.Writer) {
+		fmt.Fprintf(w, "Checked %d uploads, %d blobs and %d info files\n", report.Rows, report.Blobs, report.Infos)
+		if len(report.Problems) == 0 {
+			return
+		}
+
+		fmt.Fprintln(w)
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "PROBLEM\tID\tPATH\tREPAIR")
+		for _, problem := range report.Problems {
+			repair := problem.Repair
+			if problem.Error != "" {
+				repair = "failed: " + problem.Error
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", problem.Kind, problem.ID, problem.Path, repair)
+		}
+		tw.Flush()
+	})
+	if err != nil {
+		return err
+	}
+
+	if unrepaired := report.Unrepaired(); unrepaired > 0 {
+		return fmt.Errorf("%d problems left", unrepaired)
+	}
+	return nil
+}
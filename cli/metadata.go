@@ -0,0 +1,48 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
+)
+
+func runMetadata(env *env, args []string) error {
+	flags := flag.NewFlagSet("metadata", flag.ContinueOnError)
+	positional, err := env.parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errUsage(flags, "Expected import or export")
+	}
+
+	store, err := env.openStore()
+	if err != nil {
+		return err
+	}
+
+	var result *shardedfilestore.InfoTransfer
+	var verb string
+	switch positional[0] {
+	case "import":
+		result, err = store.ImportInfoFiles()
+		verb = "Imported %d .info files into the database"
+	case "export":
+		result, err = store.ExportInfoFiles()
+		verb = "Exported %d upload infos to .info files"
+	default:
+		return errUsage(flags, "Expected import or export")
+	}
+	if err != nil {
+		return err
+	}
+
+	return env.print(result, func(w io.Writer) {
+		fmt.Fprintf(w, verb+"\n", result.Copied)
+		if result.Skipped > 0 {
+			fmt.Fprintf(w, "Skipped %d .info files of unknown or purged uploads\n", result.Skipped)
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	migrate "github.com/rubenv/sql-migrate"
+)
+
+func runMigrate(env *env, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	limit := flags.Int("limit", 0, "run at most this many migrations, 0 for all when applying and 1 when reverting")
+	positional, err := env.parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 {
+		return errUsage(flags, "Expected status, up, down or plan")
+	}
+
+	// the schema is checked by this command, so it must not be migrated or
+	// refused when opening the store
+	store := env.connectStore()
+
+	action := positional[0]
+	switch {
+	case action == "status" && len(positional) == 1:
+		statuses, err := store.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		return env.print(statuses, func(w io.Writer) {
+			tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "MIGRATION\tAPPLIED\tREVERSIBLE")
+			for _, status := range statuses {
+				applied := "pending"
+				if status.AppliedAt != nil {
+					applied = status.AppliedAt.Local().Format("2006-01-02 15:04:05")
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%t\n", status.ID, applied, status.Reversible)
+			}
+			tw.Flush()
+		})
+
+	case (action == "up" || action == "down") && len(positional) == 1:
+		direction := migrate.Up
+		if action == "down" {
+			direction = migrate.Down
+			if *limit == 0 {
+				*limit = 1
+			}
+		}
+		ids, err := store.Migrate(direction, *limit)
+		result := struct {
+			Migrations []string `json:"migrations"`
+		}{ids}
+		if result.Migrations == nil {
+			result.Migrations = make([]string, 0)
+		}
+		printErr := env.print(result, func(w io.Writer) {
+			verb := "Applied"
+			if direction == migrate.Down {
+				verb = "Reverted"
+			}
+			if len(ids) == 0 && err == nil {
+				fmt.Fprintln(w, "No migrations to run")
+			}
+			for _, id := range ids {
+				fmt.Fprintf(w, "%s migration %s\n", verb, id)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return printErr
+
+	case action == "plan" && len(positional) <= 2:
+		direction := migrate.Up
+		if len(positional) == 2 {
+			switch positional[1] {
+			case "up":
+			case "down":
+				direction = migrate.Down
+				if *limit == 0 {
+					*limit = 1
+				}
+			default:
+				return errUsage(flags, "Expected plan up or plan down")
+			}
+		}
+		plan, err := store.PlanMigrations(direction, *limit)
+		if err != nil {
+			return err
+		}
+		return env.print(plan, func(w io.Writer) {
+			if len(plan) == 0 {
+				fmt.Fprintln(w, "No migrations to run")
+			}
+			for _, migration := range plan {
+				fmt.Fprintf(w, "-- migration %s\n", migration.ID)
+				for _, statement := range migration.Statements {
+					fmt.Fprintln(w, dedent(statement))
+				}
+				fmt.Fprintln(w)
+			}
+		})
+	}
+
+	return errUsage(flags, "Expected status, up, down or plan")
+}
+
+// dedent removes the indentation that the lines of a statement have in common
+func dedent(statement string) string {
+	lines := strings.Split(strings.Trim(statement, "\n"), "\n")
+	indent := -1
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		width := len(line) - len(strings.TrimLeft(line, " \t"))
+		if indent < 0 || width < indent {
+			indent = width
+		}
+	}
+	for i, line := range lines {
+		if len(line) >= indent {
+			lines[i] = line[indent:]
+		}
+	}
+	return strings.TrimRight(strings.Join(lines, "\n"), " \t")
+}
@@ -0,0 +1,36 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+)
+
+func runReshard(env *env, args []string) error {
+	flags := flag.NewFlagSet("reshard", flag.ContinueOnError)
+	positional, err := env.parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 0 {
+		return errUsage(flags, "Unexpected arguments")
+	}
+
+	store, err := env.openStore()
+	if err != nil {
+		return err
+	}
+	result, err := store.Reshard()
+	if err != nil {
+		return err
+	}
+
+	return env.print(result, func(w io.Writer) {
+		if result.From != nil {
+			fmt.Fprintf(w, "Resharded storage from %s to %s\n", result.From, result.To)
+		} else {
+			fmt.Fprintf(w, "Resharded storage to %s\n", result.To)
+		}
+		fmt.Fprintf(w, "Moved %d blobs and %d info files\n", result.Blobs, result.Infos)
+	})
+}
@@ -0,0 +1,337 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+
+	"github.com/kiwiirc/plugin-fileuploader/bans"
+	"github.com/kiwiirc/plugin-fileuploader/expirer"
+	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
+)
+
+func runList(env *env, args []string) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	var filter shardedfilestore.UploadFilter
+	ip := flags.String("ip", "", "only uploads from this IP address or CIDR range")
+	flags.StringVar(&filter.Account, "account", "", "only uploads by this account")
+	flags.StringVar(&filter.Issuer, "issuer", "", "only uploads by accounts of this issuer")
+	flags.StringVar(&filter.Filetype, "type", "", "only uploads whose type matches this pattern, such as image/*")
+	minSize := flags.String("min-size", "", "only uploads of at least this size, such as 100MB")
+	flags.BoolVar(&filter.LargestFirst, "largest", false, "list the largest uploads first instead of the newest")
+	flags.BoolVar(&filter.IncludeDeleted, "deleted", false, "include deleted uploads")
+	flags.IntVar(&filter.Limit, "limit", 100, "show at most this many uploads, 0 for all")
+	positional, err := env.parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 0 {
+		return errUsage(flags, "Unexpected arguments")
+	}
+
+	if *minSize != "" {
+		var size datasize.ByteSize
+		if err := size.UnmarshalText([]byte(*minSize)); err != nil {
+			return errUsage(flags, "Invalid --min-size")
+		}
+		filter.MinSize = int64(size.Bytes())
+	}
+
+	if *ip != "" {
+		filter.IPNet, err = bans.ParseIPRange(*ip)
+		if err != nil {
+			return err
+		}
+	}
+
+	store, err := env.openStore()
+	if err != nil {
+		return err
+	}
+	records, err := store.SearchUploads(filter)
+	if err != nil {
+		return err
+	}
+
+	return env.print(records, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tCREATED\tSIZE\tTYPE\tNAME\tUPLOADER\tSTATE")
+		for _, record := range records {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				record.ID,
+				formatTime(record.CreatedAt),
+				formatSize(record.Size),
+				record.Filetype,
+				record.Filename,
+				uploader(&record),
+				state(&record),
+			)
+		}
+		tw.Flush()
+	})
+}
+
+func runShow(env *env, args []string) error {
+	flags := flag.NewFlagSet("show", flag.ContinueOnError)
+	positional, err := env.parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errUsage(flags, "Expected one upload id")
+	}
+
+	store, err := env.openStore()
+	if err != nil {
+		return err
+	}
+	record, err := store.GetUploadRecord(positional[0])
+	if err != nil {
+		return err
+	}
+	reports, err := store.Reports(record.ID)
+	if err != nil {
+		return err
+	}
+
+	result := struct {
+		Upload  *shardedfilestore.UploadRecord `json:"upload"`
+		Reports []shardedfilestore.Report      `json:"reports"`
+	}{record, reports}
+
+	return env.print(result, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "ID:\t%s\n", record.ID)
+		fmt.Fprintf(tw, "State:\t%s\n", state(record))
+		fmt.Fprintf(tw, "Name:\t%s\n", record.Filename)
+		fmt.Fprintf(tw, "Type:\t%s\n", record.Filetype)
+		fmt.Fprintf(tw, "Size:\t%s\n", formatSize(record.Size))
+		fmt.Fprintf(tw, "SHA-256:\t%s\n", record.SHA256)
+		if record.PHash != nil {
+			fmt.Fprintf(tw, "Perceptual hash:\t%s\n", *record.PHash)
+		}
+		fmt.Fprintf(tw, "Uploader:\t%s\n", uploader(record))
+		fmt.Fprintf(tw, "Created:\t%s\n", formatTime(record.CreatedAt))
+		if record.CompletedAt != nil {
+			fmt.Fprintf(tw, "Completed:\t%s\n", formatTime(*record.CompletedAt))
+		}
+		if record.ExpiresAt != nil {
+			fmt.Fprintf(tw, "Expires:\t%s\n", formatTime(*record.ExpiresAt))
+		}
+		if record.DeletedAt != nil {
+			fmt.Fprintf(tw, "Deleted:\t%s\n", formatTime(*record.DeletedAt))
+		}
+		fmt.Fprintf(tw, "Private:\t%t\n", record.Private)
+		fmt.Fprintf(tw, "Password:\t%t\n", record.HasPassword)
+		if record.MaxDownloads > 0 {
+			fmt.Fprintf(tw, "Downloads:\t%d of %d\n", record.DownloadCount, record.MaxDownloads)
+		} else {
+			fmt.Fprintf(tw, "Downloads:\t%d\n", record.DownloadCount)
+		}
+		fmt.Fprintf(tw, "Bytes served:\t%s\n", formatSize(record.BytesServed))
+		if record.LastAccessedAt != nil {
+			fmt.Fprintf(tw, "Last accessed:\t%s\n", formatTime(*record.LastAccessedAt))
+		}
+		tw.Flush()
+
+		if len(reports) > 0 {
+			fmt.Fprintf(w, "\nReports:\n")
+			tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+			for _, report := range reports {
+				fmt.Fprintf(tw, "  %s\t%s\t%s\n",
+					formatTime(report.CreatedAt),
+					joinNonEmpty(" ", report.ReporterAccount, report.ReporterIP),
+					report.Reason,
+				)
+			}
+			tw.Flush()
+		}
+	})
+}
+
+func runRm(env *env, args []string) error {
+	flags := flag.NewFlagSet("rm", flag.ContinueOnError)
+	var filter shardedfilestore.UploadFilter
+	ip := flags.String("ip", "", "delete every upload from this IP address or CIDR range")
+	flags.StringVar(&filter.Account, "account", "", "delete every upload by this account, requires --issuer")
+	flags.StringVar(&filter.Issuer, "issuer", "", "the issuer of --account")
+	dryRun := flags.Bool("dry-run", false, "only print the uploads that would be deleted")
+	ids, err := env.parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	byFilter := *ip != "" || filter.Account != ""
+	if byFilter == (len(ids) > 0) {
+		return errUsage(flags, "Expected either upload ids, --ip or --account")
+	}
+	if filter.Account != "" && filter.Issuer == "" {
+		return errUsage(flags, "--account requires --issuer")
+	}
+
+	store, err := env.openStore()
+	if err != nil {
+		return err
+	}
+	if byFilter {
+		if *ip != "" {
+			filter.IPNet, err = bans.ParseIPRange(*ip)
+			if err != nil {
+				return err
+			}
+		}
+		records, err := store.SearchUploads(filter)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			ids = append(ids, record.ID)
+		}
+	}
+
+	deleted := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !*dryRun {
+			record, err := store.GetUploadRecord(id)
+			if err != nil {
+				return fmt.Errorf("%s: %w", id, err)
+			}
+			if record.Deleted {
+				env.log.Warn().Str("id", id).Msg("Upload is already deleted")
+				continue
+			}
+			if err := store.Terminate(id); err != nil {
+				return fmt.Errorf("%s: %w", id, err)
+			}
+		}
+		deleted = append(deleted, id)
+	}
+
+	result := struct {
+		Deleted []string `json:"deleted"`
+		DryRun  bool     `json:"dry_run"`
+	}{deleted, *dryRun}
+
+	return env.print(result, func(w io.Writer) {
+		verb := "Deleted"
+		if *dryRun {
+			verb = "Would delete"
+		}
+		for _, id := range deleted {
+			fmt.Fprintf(w, "%s %s\n", verb, id)
+		}
+	})
+}
+
+func runExpireNow(env *env, args []string) error {
+	flags := flag.NewFlagSet("expire-now", flag.ContinueOnError)
+	ids, err := env.parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	store, err := env.openStore()
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for _, id := range ids {
+		if err := store.SetExpiry(id, now); err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+	}
+
+	expirer.RunOnce(store, env.log)
+
+	result := struct {
+		Expired []string `json:"expired"`
+	}{ids}
+	return env.print(result, func(w io.Writer) {
+		fmt.Fprintln(w, "Expiry cycle complete")
+	})
+}
+
+func runStats(env *env, args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	positional, err := env.parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 0 {
+		return errUsage(flags, "Unexpected arguments")
+	}
+
+	store, err := env.openStore()
+	if err != nil {
+		return err
+	}
+	stats, err := store.Stats()
+	if err != nil {
+		return err
+	}
+
+	return env.print(stats, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "Uploads:\t%d\n", stats.Uploads)
+		fmt.Fprintf(tw, "  Active:\t%d (%s)\n", stats.Active, formatSize(stats.ActiveBytes))
+		fmt.Fprintf(tw, "    Identified:\t%d\n", stats.Identified)
+		fmt.Fprintf(tw, "    Quarantined:\t%d\n", stats.Quarantined)
+		fmt.Fprintf(tw, "  Incomplete:\t%d\n", stats.Incomplete)
+		fmt.Fprintf(tw, "  In trash:\t%d\n", stats.Trashed)
+		fmt.Fprintf(tw, "  Purged:\t%d\n", stats.Purged)
+		fmt.Fprintf(tw, "Downloads:\t%d\n", stats.Downloads)
+		fmt.Fprintf(tw, "Bytes served:\t%s\n", formatSize(stats.BytesServed))
+		fmt.Fprintf(tw, "Stored files:\t%d\n", stats.StoredFiles)
+		fmt.Fprintf(tw, "Stored bytes:\t%s\n", formatSize(stats.StoredBytes))
+		tw.Flush()
+
+		if len(stats.Types) > 0 {
+			fmt.Fprintf(w, "\nActive uploads by type:\n")
+			tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+			for _, fileType := range stats.Types {
+				name := fileType.Filetype
+				if name == "" {
+					name = "(unknown)"
+				}
+				fmt.Fprintf(tw, "  %s\t%d\t%s\n", name, fileType.Uploads, formatSize(fileType.Bytes))
+			}
+			tw.Flush()
+		}
+	})
+}
+
+// uploader describes who made an upload, by account when identified
+func uploader(record *shardedfilestore.UploadRecord) string {
+	if record.JwtAccount != "" {
+		return record.JwtAccount + "@" + record.JwtIssuer
+	}
+	return record.UploaderIP
+}
+
+// state describes the lifecycle state of an upload
+func state(record *shardedfilestore.UploadRecord) string {
+	switch {
+	case record.Purged:
+		return "purged"
+	case record.Deleted:
+		return "trashed"
+	case record.SHA256 == "":
+		return "incomplete"
+	case record.Quarantined:
+		return "quarantined"
+	default:
+		return "active"
+	}
+}
+
+func formatTime(unix int64) string {
+	return time.Unix(unix, 0).Format("2006-01-02 15:04:05")
+}
+
+func formatSize(bytes int64) string {
+	return datasize.ByteSize(bytes).HR()
+}
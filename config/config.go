@@ -38,21 +38,93 @@ type Config struct {
 		CorsOrigins               []string
 		TrustedReverseProxyRanges []ipnet
 		RequireJwtAccount         bool
+		AllowDeleteByIP           bool
+		DrainDelay                duration
 	}
 	Storage struct {
-		Path              string
-		ShardLayers       int
-		ExifRemove        bool
-		MaximumUploadSize datasize.ByteSize
+		Path               string
+		ShardLayers        int
+		ShardWidth         int
+		ExifRemove         bool
+		MaximumUploadSize  datasize.ByteSize
+		MetadataInDatabase bool
 	}
 	Database struct {
-		Type string
-		Path string
+		Type        string
+		Path        string
+		AutoMigrate bool
 	}
 	Expiration struct {
 		MaxAge           duration
 		IdentifiedMaxAge duration
 		CheckInterval    duration
+		TrashRetention   duration
+		SlidingStep      duration
+		SlidingMaxAge    duration
+	}
+	DiskGuard struct {
+		CheckInterval   duration
+		RejectBelowFree datasize.ByteSize
+		EvictBelowFree  datasize.ByteSize
+		EvictOrder      string
+		MaxTotalSize    datasize.ByteSize
+	}
+	Downloads struct {
+		PreviewBotUserAgents  []string
+		PasswordAttempts      int
+		PasswordAttemptWindow duration
+		StatsFlushInterval    duration
+	}
+	SignedUrls struct {
+		SigningKey string
+		DefaultTtl duration
+		MaxTtl     duration
+		Keys       map[string]string
+	}
+	Blocklist struct {
+		Files        []string
+		UseDatabase  bool
+		RejectStatus int
+
+		HashImages          bool
+		PerceptualFiles     []string
+		PerceptualThreshold int
+		PerceptualAction    string
+	}
+	ClamAV struct {
+		Address        string
+		Timeout        duration
+		Action         string
+		FailOpen       bool
+		AcceptOversize bool
+	}
+	ICAP struct {
+		ServiceUrl  string
+		Method      string
+		Timeout     duration
+		PreviewSize int
+		FailOpen    bool
+		Headers     map[string]string
+	}
+	Reports struct {
+		QuarantineThreshold int
+		RateLimit           int
+		RateLimitWindow     duration
+		MaxReasonLength     int
+	}
+	Bans struct {
+		EnforceOnDownloads bool
+		RefreshInterval    duration
+		FailOpen           bool
+	}
+	Admin struct {
+		ApiKeys   []string
+		JwtIssuer string
+		JwtSecret string
+	}
+	Metrics struct {
+		Enabled       bool
+		ListenAddress string
 	}
 	PreFinishCommands  []PreFinishCommand
 	JwtSecretsByIssuer map[string]string
@@ -102,7 +174,31 @@ func NewConfig() *Config {
 
 func (cfg *Config) Load(log *zerolog.Logger, configPath string) (toml.MetaData, error) {
 	md, configLoadErr := toml.DecodeFile(configPath, cfg)
-	return md, configLoadErr
+	if configLoadErr != nil {
+		return md, configLoadErr
+	}
+	return md, cfg.validate()
+}
+
+// validate rejects settings that would leave the server insecure or that
+// can't be acted on
+func (cfg *Config) validate() error {
+	if cfg.Admin.JwtIssuer != "" && cfg.Admin.JwtSecret == "" {
+		return errors.New("Admin.JwtSecret must be set when Admin.JwtIssuer is")
+	}
+
+	switch cfg.Blocklist.PerceptualAction {
+	case "reject", "quarantine", "log":
+	default:
+		return fmt.Errorf(`Blocklist.PerceptualAction must be "reject", "quarantine" or "log", not %q`, cfg.Blocklist.PerceptualAction)
+	}
+
+	switch cfg.ClamAV.Action {
+	case "reject", "quarantine":
+	default:
+		return fmt.Errorf(`ClamAV.Action must be "reject" or "quarantine", not %q`, cfg.ClamAV.Action)
+	}
+	return nil
 }
 
 func (cfg *Config) DoPostLoadLogging(log *zerolog.Logger, configPath string, md toml.MetaData) {
@@ -1,6 +1,8 @@
 package db
 
 import (
+	"database/sql"
+	"database/sql/driver"
 	"fmt"
 	"strings"
 
@@ -27,13 +29,21 @@ func ConnectToDB(log *zerolog.Logger, dbConfig DBConfig) *DatabaseConnection {
 			dbConfig.DSN += "?_busy_timeout=5000&cache=shared"
 		case "mysql":
 			dbConfig.DSN += "?parseTime=true"
+		case "postgres":
+			// key=value connection strings take no query string, and URLs
+			// need no extra options
 		}
 	}
 
-	db, err := sqlx.Open(dbConfig.DriverName, dbConfig.DSN)
+	// the registered driver is looked up by name, then wrapped to time the
+	// statements run through it
+	registered, err := sql.Open(dbConfig.DriverName, "")
 	if err != nil {
 		log.Fatal().Err(err).Msg("Could not open database")
 	}
+	connector := &instrumentedConnector{dsn: dbConfig.DSN, driver: registered.Driver()}
+	registered.Close()
+	db := sqlx.NewDb(sql.OpenDB(connector), dbConfig.DriverName)
 
 	// note that we don't do db.SetMaxOpenConns(1), as we don't want to limit
 	// read concurrency unnecessarily. sqlite will handle write locking on its
@@ -51,7 +61,7 @@ func ConnectToDB(log *zerolog.Logger, dbConfig DBConfig) *DatabaseConnection {
 
 // UpdateRow wraps db.Exec and ensures that exactly one row was affected
 func UpdateRow(db *sqlx.DB, query string, args ...interface{}) (err error) {
-	res, err := db.Exec(query, args...)
+	res, err := db.Exec(db.Rebind(query), args...)
 	if err != nil {
 		return
 	}
@@ -65,3 +75,25 @@ func UpdateRow(db *sqlx.DB, query string, args ...interface{}) (err error) {
 	}
 	return
 }
+
+// Bool is a boolean stored in an INTEGER(1) column. Postgres refuses to
+// convert booleans to integers, so they are passed as 0 or 1.
+type Bool bool
+
+// Value implements driver.Valuer
+func (b Bool) Value() (driver.Value, error) {
+	if b {
+		return int64(1), nil
+	}
+	return int64(0), nil
+}
+
+// Scan implements sql.Scanner
+func (b *Bool) Scan(src interface{}) error {
+	value, err := driver.Bool.ConvertValue(src)
+	if err != nil {
+		return err
+	}
+	*b = Bool(value.(bool))
+	return nil
+}
@@ -0,0 +1,175 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"time"
+
+	"github.com/kiwiirc/plugin-fileuploader/metrics"
+)
+
+// instrumentedConnector opens connections that time the statements they run
+type instrumentedConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (connector *instrumentedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	var conn driver.Conn
+	var err error
+	if driverCtx, ok := connector.driver.(driver.DriverContext); ok {
+		var inner driver.Connector
+		inner, err = driverCtx.OpenConnector(connector.dsn)
+		if err != nil {
+			return nil, err
+		}
+		conn, err = inner.Connect(ctx)
+	} else {
+		conn, err = connector.driver.Open(connector.dsn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{conn}, nil
+}
+
+func (connector *instrumentedConnector) Driver() driver.Driver {
+	return connector.driver
+}
+
+// observe records how long a statement took since start
+func observe(operation string, start time.Time) {
+	metrics.DBQueryDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// instrumentedConn wraps a driver connection. The optional interfaces of the
+// driver are passed through, returning driver.ErrSkip when the driver doesn't
+// implement them so that database/sql falls back to its generic behaviour.
+type instrumentedConn struct {
+	driver.Conn
+}
+
+func (conn *instrumentedConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := conn.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedStmt{stmt, conn}, nil
+}
+
+func (conn *instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	preparer, ok := conn.Conn.(driver.ConnPrepareContext)
+	if !ok {
+		return conn.Prepare(query)
+	}
+	stmt, err := preparer.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedStmt{stmt, conn}, nil
+}
+
+func (conn *instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := conn.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	if opts.Isolation != 0 || opts.ReadOnly {
+		return nil, errors.New("database driver does not support transaction options")
+	}
+	return conn.Conn.Begin()
+}
+
+func (conn *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := conn.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	defer observe("exec", time.Now())
+	return execer.ExecContext(ctx, query, args)
+}
+
+func (conn *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := conn.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	defer observe("query", time.Now())
+	return queryer.QueryContext(ctx, query, args)
+}
+
+func (conn *instrumentedConn) Ping(ctx context.Context) error {
+	if pinger, ok := conn.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (conn *instrumentedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := conn.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (conn *instrumentedConn) IsValid() bool {
+	if validator, ok := conn.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (conn *instrumentedConn) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := conn.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+// instrumentedStmt wraps a prepared statement of an instrumentedConn
+type instrumentedStmt struct {
+	driver.Stmt
+	conn *instrumentedConn
+}
+
+func (stmt *instrumentedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	defer observe("exec", time.Now())
+	if execer, ok := stmt.Stmt.(driver.StmtExecContext); ok {
+		return execer.ExecContext(ctx, args)
+	}
+	values, err := namedValuesToValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Stmt.Exec(values)
+}
+
+func (stmt *instrumentedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	defer observe("query", time.Now())
+	if queryer, ok := stmt.Stmt.(driver.StmtQueryContext); ok {
+		return queryer.QueryContext(ctx, args)
+	}
+	values, err := namedValuesToValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Stmt.Query(values)
+}
+
+func (stmt *instrumentedStmt) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := stmt.Stmt.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return stmt.conn.CheckNamedValue(value)
+}
+
+func namedValuesToValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("database driver does not support named parameters")
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
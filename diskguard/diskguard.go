@@ -0,0 +1,293 @@
+// Package diskguard keeps the storage from filling its disk. It refuses new
+// uploads when free space runs low or the uploads outgrow a size cap, and
+// evicts anonymous uploads when free space runs critically low.
+package diskguard
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/kiwiirc/plugin-fileuploader/metrics"
+	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
+)
+
+var (
+	// ErrLowSpace is returned by Admit when free space is below the reject
+	// threshold
+	ErrLowSpace = errors.New("Storage is low on free space")
+	// ErrOverCap is returned by Admit when an upload would take the storage
+	// over its size cap
+	ErrOverCap = errors.New("Storage size limit reached")
+)
+
+// Limits configures a Guard. Zero disables each limit.
+type Limits struct {
+	RejectBelowFree uint64 // free bytes under which new uploads are refused
+	EvictBelowFree  uint64 // free bytes under which anonymous uploads are evicted
+	MaxTotalSize    uint64 // declared bytes of uploads over which new uploads are refused
+	EvictOrder      string // "oldest" or "largest" first
+}
+
+// Enabled returns whether any limit is set
+func (limits Limits) Enabled() bool {
+	return limits.RejectBelowFree > 0 || limits.EvictBelowFree > 0 || limits.MaxTotalSize > 0
+}
+
+type Guard struct {
+	ticker   *time.Ticker
+	store    *shardedfilestore.ShardedFileStore
+	limits   Limits
+	quitChan chan struct{} // closes when ticker has been stopped
+	log      *zerolog.Logger
+
+	mu        sync.Mutex
+	free      uint64 // free bytes at the last check
+	total     uint64 // declared bytes of uploads at the last check
+	freeKnown bool   // false when free space can't be read on this platform
+}
+
+func New(store *shardedfilestore.ShardedFileStore, limits Limits, checkInterval time.Duration, log *zerolog.Logger) *Guard {
+	guard := &Guard{
+		ticker:   time.NewTicker(checkInterval),
+		store:    store,
+		limits:   limits,
+		quitChan: make(chan struct{}),
+		log:      log,
+	}
+
+	// start with measuring the storage, so that a server starting on a full
+	// disk doesn't accept uploads until the first tick. Evicting can take a
+	// while, so it is left to the background.
+	free, freeKnown := guard.measure()
+
+	go func() {
+		if freeKnown && free < guard.limits.EvictBelowFree {
+			guard.evict(free)
+		}
+
+		for {
+			select {
+
+			// tick
+			case <-guard.ticker.C:
+				guard.check()
+
+			// ticker stopped, exit the goroutine
+			case _, ok := <-guard.quitChan:
+				if !ok {
+					return
+				}
+
+			}
+		}
+	}()
+
+	return guard
+}
+
+// Stop turns off a Guard. No more checks will start.
+func (guard *Guard) Stop() {
+	guard.ticker.Stop()
+	close(guard.quitChan)
+}
+
+// Admit returns an error when length bytes of new upload content must be
+// refused. The length is 0 when it isn't known yet. Admitted lengths are
+// counted against the limits until the next check measures them.
+func (guard *Guard) Admit(length uint64) error {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	if guard.freeKnown && guard.limits.RejectBelowFree > 0 {
+		if guard.free < guard.limits.RejectBelowFree+length {
+			return ErrLowSpace
+		}
+	}
+	if guard.limits.MaxTotalSize > 0 {
+		if guard.total+length > guard.limits.MaxTotalSize {
+			return ErrOverCap
+		}
+	}
+
+	guard.total += length
+	if guard.free > length {
+		guard.free -= length
+	} else {
+		guard.free = 0
+	}
+	return nil
+}
+
+// check measures the storage and evicts uploads when free space is
+// critically low
+func (guard *Guard) check() {
+	free, freeKnown := guard.measure()
+	if freeKnown && free < guard.limits.EvictBelowFree {
+		guard.evict(free)
+	}
+}
+
+// measure reads the free space and size of the storage that Admit checks
+// against, and returns the free space
+func (guard *Guard) measure() (free uint64, freeKnown bool) {
+	free, freeKnown = guard.freeSpace()
+
+	var total uint64
+	if guard.limits.MaxTotalSize > 0 {
+		allocated, err := guard.store.AllocatedBytes()
+		if err != nil {
+			guard.log.Error().
+				Err(err).
+				Msg("Failed to measure storage size")
+		} else {
+			total = uint64(allocated)
+		}
+	}
+
+	guard.mu.Lock()
+	guard.free, guard.total, guard.freeKnown = free, total, freeKnown
+	guard.mu.Unlock()
+
+	return free, freeKnown
+}
+
+// freeSpace returns the free bytes of the storage filesystem, and whether
+// they could be read
+func (guard *Guard) freeSpace() (uint64, bool) {
+	space, err := guard.store.DiskSpace()
+	if errors.Is(err, shardedfilestore.ErrDiskSpaceUnsupported) {
+		return 0, false
+	} else if err != nil {
+		guard.log.Error().
+			Err(err).
+			Msg("Failed to measure free disk space")
+		return 0, false
+	}
+	return space.Free, true
+}
+
+// evict removes uploads until free space is back above both thresholds.
+// Trashed uploads go first as they are already deleted, then anonymous
+// uploads in the configured order. Uploads of identified users are kept.
+func (guard *Guard) evict(free uint64) {
+	target := guard.limits.EvictBelowFree
+	if guard.limits.RejectBelowFree > target {
+		target = guard.limits.RejectBelowFree
+	}
+
+	guard.log.Warn().
+		Str("event", "eviction_started").
+		Uint64("free", free).
+		Uint64("target", target).
+		Str("order", guard.evictOrder()).
+		Msg("Free disk space is critically low, evicting uploads")
+
+	enough := func() bool {
+		free, ok := guard.freeSpace()
+		return !ok || free >= target
+	}
+
+	trashed, err := guard.store.ListTrashed()
+	if err != nil {
+		guard.log.Error().
+			Err(err).
+			Msg("Failed to enumerate trashed uploads")
+		return
+	}
+	for _, candidate := range trashed {
+		if enough() {
+			guard.finish()
+			return
+		}
+		guard.remove(candidate)
+	}
+
+	candidates, err := guard.store.ListEvictable(guard.evictOrder() == "largest")
+	if err != nil {
+		guard.log.Error().
+			Err(err).
+			Msg("Failed to enumerate evictable uploads")
+		return
+	}
+	for _, candidate := range candidates {
+		if enough() {
+			guard.finish()
+			return
+		}
+		if guard.store.IsDownloading(candidate.ID) {
+			guard.log.Info().
+				Str("event", "eviction_skipped").
+				Str("id", candidate.ID).
+				Str("reason", "downloading").
+				Msg("Not evicting upload that is being downloaded")
+			continue
+		}
+		guard.remove(candidate)
+	}
+
+	if enough() {
+		guard.finish()
+		return
+	}
+	free, _ = guard.freeSpace()
+	guard.log.Error().
+		Str("event", "eviction_exhausted").
+		Uint64("free", free).
+		Uint64("target", target).
+		Msg("No uploads left to evict, free disk space is still critically low")
+}
+
+func (guard *Guard) evictOrder() string {
+	if guard.limits.EvictOrder == "largest" {
+		return "largest"
+	}
+	return "oldest"
+}
+
+func (guard *Guard) finish() {
+	free, _ := guard.freeSpace()
+	guard.log.Info().
+		Str("event", "eviction_finished").
+		Uint64("free", free).
+		Msg("Free disk space is back above the eviction target")
+}
+
+// remove terminates an upload and purges its files straight away, as
+// keeping them in the trash would free no space
+func (guard *Guard) remove(candidate shardedfilestore.EvictionCandidate) {
+	state := "active"
+	if candidate.Deleted {
+		state = "trashed"
+	}
+
+	if !candidate.Deleted {
+		if err := guard.store.Terminate(candidate.ID); err != nil {
+			guard.log.Error().
+				Err(err).
+				Str("id", candidate.ID).
+				Msg("Failed to terminate evicted upload")
+			return
+		}
+	}
+	if guard.store.TrashRetention > 0 || candidate.Deleted {
+		if err := guard.store.Purge(candidate.ID); err != nil {
+			guard.log.Error().
+				Err(err).
+				Str("id", candidate.ID).
+				Msg("Failed to purge evicted upload")
+			return
+		}
+	}
+
+	metrics.UploadsEvicted.WithLabelValues(state).Inc()
+	guard.log.Warn().
+		Str("event", "evicted").
+		Str("id", candidate.ID).
+		Str("state", state).
+		Int64("size", candidate.Size).
+		Int64("created_at", candidate.CreatedAt).
+		Msg("Evicted upload to free disk space")
+}
@@ -3,6 +3,7 @@ package expirer
 import (
 	"time"
 
+	"github.com/kiwiirc/plugin-fileuploader/metrics"
 	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
 	"github.com/rs/zerolog"
 )
@@ -49,20 +50,45 @@ func (expirer *Expirer) Stop() {
 	close(expirer.quitChan)
 }
 
+// RunOnce runs a single garbage collection cycle without starting an Expirer
+func RunOnce(store *shardedfilestore.ShardedFileStore, log *zerolog.Logger) {
+	expirer := &Expirer{
+		store: store,
+		log:   log,
+	}
+	expirer.gc(time.Now())
+}
+
 func (expirer *Expirer) gc(t time.Time) {
 	expirer.log.Debug().
 		Str("event", "gc_tick").
 		Msg("Filestore GC tick")
 
-	var expiredIds []string
-	err := expirer.store.DBConn.DB.Select(&expiredIds, `
-		SELECT id
+	defer func(start time.Time) {
+		metrics.GCDuration.Observe(time.Since(start).Seconds())
+	}(time.Now())
+
+	// apply expiry extensions from downloads that have not been written yet
+	err := expirer.store.FlushDownloadStats()
+	if err != nil {
+		expirer.log.Error().
+			Err(err).
+			Msg("Failed to flush download statistics")
+	}
+
+	var expired []struct {
+		ID         string `db:"id"`
+		JwtAccount string `db:"jwt_account"`
+		JwtIssuer  string `db:"jwt_issuer"`
+	}
+	err = expirer.store.DBConn.DB.Select(&expired, expirer.store.DBConn.DB.Rebind(`
+		SELECT id, jwt_account, jwt_issuer
 		FROM uploads
-		WHERE deleted = 0 AND (
-			expires_at <= ? OR (expires_at IS NULL AND created_at <= ?)
-		)`,
+		WHERE deleted = 0 AND quarantined = 0 AND (
+			expires_at <= ? OR (completed_at IS NULL AND created_at <= ?)
+		)`),
 		time.Now().Unix(),
-		time.Now().Unix()-86400, // 1 day
+		time.Now().Unix()-86400, // unfinished uploads are given 1 day
 	)
 	if err != nil {
 		expirer.log.Error().
@@ -71,17 +97,69 @@ func (expirer *Expirer) gc(t time.Time) {
 		return
 	}
 
-	for _, id := range expiredIds {
+	for _, upload := range expired {
+		id := upload.ID
+		if expirer.store.IsDownloading(id) {
+			// try again on the next tick rather than cutting off the download
+			expirer.log.Debug().
+				Str("event", "expiry_deferred").
+				Str("id", id).
+				Msg("Upload is being downloaded, deferring expiry")
+			metrics.GCItems.WithLabelValues("deferred").Inc()
+			continue
+		}
+
 		err = expirer.store.Terminate(id)
 		if err != nil {
 			expirer.log.Error().
 				Err(err).
 				Msg("Failed to terminate expired upload")
+			metrics.GCItems.WithLabelValues("failed").Inc()
 			continue
 		}
+		metrics.GCItems.WithLabelValues("expired").Inc()
+		metrics.UploadsExpired.With(metrics.UploaderLabels(map[string]string{
+			"account": upload.JwtAccount,
+			"issuer":  upload.JwtIssuer,
+		})).Inc()
 		expirer.log.Info().
 			Str("event", "expired").
 			Str("id", id).
 			Msg("Terminated upload id")
 	}
+
+	expirer.purgeTrash(t)
+}
+
+// purgeTrash removes the files of uploads that have outlived the trash retention period
+func (expirer *Expirer) purgeTrash(t time.Time) {
+	var trashedIds []string
+	err := expirer.store.DBConn.DB.Select(&trashedIds, expirer.store.DBConn.DB.Rebind(`
+		SELECT id
+		FROM uploads
+		WHERE deleted = 1 AND purged = 0 AND deleted_at <= ?`),
+		t.Add(-expirer.store.TrashRetention).Unix(),
+	)
+	if err != nil {
+		expirer.log.Error().
+			Err(err).
+			Msg("Failed to enumerate trashed uploads")
+		return
+	}
+
+	for _, id := range trashedIds {
+		err = expirer.store.Purge(id)
+		if err != nil {
+			expirer.log.Error().
+				Err(err).
+				Msg("Failed to purge trashed upload")
+			metrics.GCItems.WithLabelValues("failed").Inc()
+			continue
+		}
+		metrics.GCItems.WithLabelValues("purged").Inc()
+		expirer.log.Info().
+			Str("event", "purged").
+			Str("id", id).
+			Msg("Purged upload id")
+	}
 }
@@ -0,0 +1,372 @@
+// Package icap is a client for content inspection servers speaking ICAP
+// (RFC 3507), such as DLP and antivirus appliances.
+package icap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultPort = "1344"
+
+// infectionHeaders are ICAP response headers that servers use to report a
+// blocked file while still returning its content
+var infectionHeaders = []string{"X-Infection-Found", "X-Violations-Found", "X-Virus-ID"}
+
+// Verdict is the decision of the ICAP server about a file
+type Verdict int
+
+const (
+	// Allowed files can be stored unchanged
+	Allowed Verdict = iota
+	// Blocked files must be rejected
+	Blocked
+	// Modified files were rewritten by the server, the new content has been
+	// written to the writer passed to ScanFile
+	Modified
+)
+
+// Client sends files to an ICAP service
+type Client struct {
+	URL         *url.URL      // icap://host[:port]/service
+	Method      string        // "REQMOD" or "RESPMOD"
+	Timeout     time.Duration // Limit on the time taken by a whole scan
+	PreviewSize int           // Bytes sent before waiting for the server to ask for the rest, 0 disables previews
+}
+
+// Request describes the file being scanned
+type Request struct {
+	Filename    string
+	ContentType string
+	Headers     http.Header // Extra ICAP headers
+}
+
+// Result is the outcome of a scan
+type Result struct {
+	Verdict Verdict
+	Reason  string // Why a file was blocked, as reported by the server
+}
+
+// New creates a client for the ICAP service at serviceURL
+func New(serviceURL, method string, timeout time.Duration, previewSize int) (*Client, error) {
+	parsed, err := url.Parse(serviceURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "icap" {
+		return nil, fmt.Errorf("unsupported ICAP service URL %#v", serviceURL)
+	}
+
+	method = strings.ToUpper(method)
+	if method != "REQMOD" && method != "RESPMOD" {
+		return nil, fmt.Errorf("unsupported ICAP method %#v", method)
+	}
+
+	return &Client{
+		URL:         parsed,
+		Method:      method,
+		Timeout:     timeout,
+		PreviewSize: previewSize,
+	}, nil
+}
+
+// ScanFile sends the file at path to the ICAP service. When the server
+// replaces the content, the new content is written to modified.
+func (client *Client) ScanFile(path string, request Request, modified io.Writer) (Result, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Result{}, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return Result{}, err
+	}
+
+	host := client.URL.Host
+	if client.URL.Port() == "" {
+		host = net.JoinHostPort(host, defaultPort)
+	}
+
+	conn, err := net.DialTimeout("tcp", host, client.Timeout)
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+
+	if client.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(client.Timeout))
+	}
+
+	w := bufio.NewWriter(conn)
+	r := bufio.NewReader(conn)
+
+	preview := client.PreviewSize > 0
+	var rest []byte
+	err = client.writeHeaders(w, request, stat.Size(), preview)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if preview {
+		var complete bool
+		rest, complete, err = writePreview(w, file, client.PreviewSize)
+		if err != nil {
+			return Result{}, err
+		}
+		if err := w.Flush(); err != nil {
+			return Result{}, err
+		}
+
+		status, header, err := readResponseHead(r)
+		if err != nil {
+			return Result{}, err
+		}
+		if status != http.StatusContinue || complete {
+			return client.readResult(r, status, header, modified)
+		}
+	}
+
+	// send the rest of the file
+	if err := writeChunks(w, io.MultiReader(bytes.NewReader(rest), file)); err != nil {
+		return Result{}, err
+	}
+	if _, err := io.WriteString(w, "0\r\n\r\n"); err != nil {
+		return Result{}, err
+	}
+	if err := w.Flush(); err != nil {
+		return Result{}, err
+	}
+
+	status, header, err := readResponseHead(r)
+	if err != nil {
+		return Result{}, err
+	}
+	return client.readResult(r, status, header, modified)
+}
+
+// writeHeaders writes the ICAP request headers followed by the encapsulated
+// HTTP headers describing the file
+func (client *Client) writeHeaders(w io.Writer, request Request, size int64, preview bool) error {
+	path := "/" + url.PathEscape(request.Filename)
+	contentType := request.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	var encapsulated string
+	var httpHeaders string
+	if client.Method == "REQMOD" {
+		httpHeaders = fmt.Sprintf("PUT %s HTTP/1.1\r\nHost: %s\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n",
+			path, client.URL.Hostname(), contentType, size)
+		encapsulated = fmt.Sprintf("req-hdr=0, req-body=%d", len(httpHeaders))
+	} else {
+		reqHeaders := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", path, client.URL.Hostname())
+		resHeaders := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n", contentType, size)
+		httpHeaders = reqHeaders + resHeaders
+		encapsulated = fmt.Sprintf("req-hdr=0, res-hdr=%d, res-body=%d", len(reqHeaders), len(httpHeaders))
+	}
+
+	header := http.Header{}
+	for name, values := range request.Headers {
+		header[textproto.CanonicalMIMEHeaderKey(name)] = values
+	}
+	header.Set("Host", client.URL.Host)
+	header.Set("Allow", "204")
+	header.Set("Encapsulated", encapsulated)
+	if preview {
+		header.Set("Preview", strconv.Itoa(client.PreviewSize))
+	}
+
+	_, err := fmt.Fprintf(w, "%s %s ICAP/1.0\r\n", client.Method, client.URL.String())
+	if err != nil {
+		return err
+	}
+	if err := header.Write(w); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\r\n"+httpHeaders)
+	return err
+}
+
+// writePreview sends up to size bytes of the file. It returns the bytes read
+// past the preview, and whether the preview held the whole file.
+func writePreview(w io.Writer, file io.Reader, size int) (rest []byte, complete bool, err error) {
+	// read one byte more than the preview to find out if the file continues
+	buf := make([]byte, size+1)
+	n, err := io.ReadFull(file, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		complete = true
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	if complete {
+		if n > 0 {
+			if err := writeChunk(w, buf[:n]); err != nil {
+				return nil, false, err
+			}
+		}
+		_, err = io.WriteString(w, "0; ieof\r\n\r\n")
+		return nil, true, err
+	}
+
+	if err := writeChunk(w, buf[:size]); err != nil {
+		return nil, false, err
+	}
+	_, err = io.WriteString(w, "0\r\n\r\n")
+	return buf[size:], false, err
+}
+
+func writeChunks(w io.Writer, file io.Reader) error {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			if err := writeChunk(w, buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func writeChunk(w io.Writer, data []byte) error {
+	if _, err := fmt.Fprintf(w, "%x\r\n", len(data)); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// readResponseHead reads the status and headers of an ICAP response
+func readResponseHead(r *bufio.Reader) (status int, header textproto.MIMEHeader, err error) {
+	tp := textproto.NewReader(r)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// ICAP/1.0 204 No Content
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "ICAP/") {
+		return 0, nil, fmt.Errorf("malformed ICAP status line %#v", line)
+	}
+	status, err = strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, nil, fmt.Errorf("malformed ICAP status line %#v", line)
+	}
+
+	header, err = tp.ReadMIMEHeader()
+	return status, header, err
+}
+
+// readResult interprets the final ICAP response, copying any replacement
+// content to modified
+func (client *Client) readResult(r *bufio.Reader, status int, header textproto.MIMEHeader, modified io.Writer) (Result, error) {
+	switch status {
+	case http.StatusNoContent:
+		return Result{Verdict: Allowed}, nil
+	case http.StatusOK:
+	default:
+		return Result{}, fmt.Errorf("ICAP server responded with status %d", status)
+	}
+
+	offsets, err := parseEncapsulated(header.Get("Encapsulated"))
+	if err != nil {
+		return Result{}, err
+	}
+
+	// the encapsulated HTTP headers come before the body
+	headersLen, hasBody := offsets["req-body"]
+	if !hasBody {
+		headersLen, hasBody = offsets["res-body"]
+	}
+	if !hasBody {
+		headersLen = offsets["null-body"]
+	}
+	httpHeaders := make([]byte, headersLen)
+	if _, err := io.ReadFull(r, httpHeaders); err != nil {
+		return Result{}, err
+	}
+
+	for _, name := range infectionHeaders {
+		if reason := header.Get(name); reason != "" {
+			return Result{Verdict: Blocked, Reason: reason}, nil
+		}
+	}
+
+	if resOffset, ok := offsets["res-hdr"]; ok {
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(httpHeaders[resOffset:])), nil)
+		if err != nil {
+			return Result{}, err
+		}
+		resp.Body.Close()
+
+		// REQMOD servers block a request by answering it with a response
+		// instead, RESPMOD servers by replacing the response status
+		if client.Method == "REQMOD" || resp.StatusCode != http.StatusOK {
+			return Result{Verdict: Blocked, Reason: resp.Status}, nil
+		}
+	}
+
+	if !hasBody {
+		return Result{Verdict: Allowed}, nil
+	}
+
+	_, err = io.Copy(modified, httputil.NewChunkedReader(r))
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{Verdict: Modified}, nil
+}
+
+// parseEncapsulated parses an Encapsulated header such as
+// "res-hdr=0, res-body=123" into the offset of each section
+func parseEncapsulated(value string) (map[string]int, error) {
+	offsets := make(map[string]int)
+	for _, part := range strings.Split(value, ",") {
+		name, offsetStr, ok := cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed Encapsulated header %#v", value)
+		}
+		offset, err := strconv.Atoi(offsetStr)
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("malformed Encapsulated header %#v", value)
+		}
+		offsets[name] = offset
+	}
+
+	if len(offsets) == 0 {
+		return nil, errors.New("missing Encapsulated header")
+	}
+	return offsets, nil
+}
+
+func cut(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,183 @@
+package icap
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseEncapsulated(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[string]int
+		wantErr bool
+	}{
+		{"null-body=0", map[string]int{"null-body": 0}, false},
+		{"res-hdr=0, res-body=123", map[string]int{"res-hdr": 0, "res-body": 123}, false},
+		{"req-hdr=0,res-hdr=45,res-body=90", map[string]int{"req-hdr": 0, "res-hdr": 45, "res-body": 90}, false},
+		{"", nil, true},
+		{"res-hdr", nil, true},
+		{"res-body=abc", nil, true},
+		{"res-body=-1", nil, true},
+	}
+
+	for _, test := range tests {
+		got, err := parseEncapsulated(test.value)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseEncapsulated(%q) error = %v, want error %v", test.value, err, test.wantErr)
+			continue
+		}
+		if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseEncapsulated(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+// icapResponse builds an ICAP response encapsulating the given HTTP response
+// headers and chunked body, either of which can be empty
+func icapResponse(status string, header string, httpHeaders string, body string) string {
+	var encapsulated string
+	switch {
+	case httpHeaders != "" && body != "":
+		encapsulated = fmt.Sprintf("res-hdr=0, res-body=%d", len(httpHeaders))
+	case httpHeaders != "":
+		encapsulated = fmt.Sprintf("res-hdr=0, null-body=%d", len(httpHeaders))
+	default:
+		encapsulated = "null-body=0"
+	}
+
+	response := "ICAP/1.0 " + status + "\r\n" + header + "Encapsulated: " + encapsulated + "\r\n\r\n" + httpHeaders
+	if body != "" {
+		response += fmt.Sprintf("%x\r\n%s\r\n0\r\n\r\n", len(body), body)
+	}
+	return response
+}
+
+func TestReadResult(t *testing.T) {
+	okHeaders := "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n"
+	forbiddenHeaders := "HTTP/1.1 403 Forbidden\r\nContent-Type: text/html\r\n\r\n"
+
+	tests := []struct {
+		name         string
+		method       string
+		response     string
+		want         Result
+		wantModified string
+		wantErr      bool
+	}{
+		{
+			name:     "no content",
+			method:   "RESPMOD",
+			response: "ICAP/1.0 204 No Content\r\nISTag: \"1\"\r\n\r\n",
+			want:     Result{Verdict: Allowed},
+		},
+		{
+			name:         "replaced body",
+			method:       "RESPMOD",
+			response:     icapResponse("200 OK", "", okHeaders, "cleaned"),
+			want:         Result{Verdict: Modified},
+			wantModified: "cleaned",
+		},
+		{
+			name:     "infection header",
+			method:   "RESPMOD",
+			response: icapResponse("200 OK", "X-Infection-Found: Type=0; Resolution=2; Threat=Eicar;\r\n", okHeaders, "blocked"),
+			want:     Result{Verdict: Blocked, Reason: "Type=0; Resolution=2; Threat=Eicar;"},
+		},
+		{
+			name:     "replaced response status",
+			method:   "RESPMOD",
+			response: icapResponse("200 OK", "", forbiddenHeaders, "denied"),
+			want:     Result{Verdict: Blocked, Reason: "403 Forbidden"},
+		},
+		{
+			name:     "request answered",
+			method:   "REQMOD",
+			response: icapResponse("200 OK", "", okHeaders, "denied"),
+			want:     Result{Verdict: Blocked, Reason: "200 OK"},
+		},
+		{
+			name:     "unchanged without body",
+			method:   "RESPMOD",
+			response: icapResponse("200 OK", "", okHeaders, ""),
+			want:     Result{Verdict: Allowed},
+		},
+		{
+			name:     "server error",
+			method:   "RESPMOD",
+			response: "ICAP/1.0 500 Server Error\r\n\r\n",
+			wantErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &Client{Method: test.method}
+			r := bufio.NewReader(strings.NewReader(test.response))
+
+			status, header, err := readResponseHead(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var modified bytes.Buffer
+			got, err := client.readResult(r, status, header, &modified)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("readResult() error = %v, want error %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("readResult() = %+v, want %+v", got, test.want)
+			}
+			if modified.String() != test.wantModified {
+				t.Errorf("modified content = %q, want %q", modified.String(), test.wantModified)
+			}
+		})
+	}
+}
+
+func TestReadResponseHeadMalformed(t *testing.T) {
+	for _, line := range []string{"HTTP/1.1 200 OK", "ICAP/1.0", "ICAP/1.0 abc OK"} {
+		r := bufio.NewReader(strings.NewReader(line + "\r\n\r\n"))
+		if _, _, err := readResponseHead(r); err == nil {
+			t.Errorf("readResponseHead(%q) succeeded", line)
+		}
+	}
+}
+
+func TestWritePreview(t *testing.T) {
+	tests := []struct {
+		name         string
+		file         string
+		size         int
+		want         string
+		wantRest     string
+		wantComplete bool
+	}{
+		{"empty file", "", 4, "0; ieof\r\n\r\n", "", true},
+		{"shorter than preview", "abc", 4, "3\r\nabc\r\n0; ieof\r\n\r\n", "", true},
+		{"same size as preview", "abcd", 4, "4\r\nabcd\r\n0; ieof\r\n\r\n", "", true},
+		{"longer than preview", "abcdefgh", 4, "4\r\nabcd\r\n0\r\n\r\n", "e", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var w bytes.Buffer
+			rest, complete, err := writePreview(&w, strings.NewReader(test.file), test.size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w.String() != test.want {
+				t.Errorf("wrote %q, want %q", w.String(), test.want)
+			}
+			if string(rest) != test.wantRest {
+				t.Errorf("rest = %q, want %q", rest, test.wantRest)
+			}
+			if complete != test.wantComplete {
+				t.Errorf("complete = %v, want %v", complete, test.wantComplete)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+// Package imagehash computes perceptual hashes of images, which stay similar
+// when an image is re-encoded, resized or slightly altered.
+package imagehash
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math/bits"
+	"os"
+	"strconv"
+
+	// register decoders for the image formats that can be hashed
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// MaxPixels is the largest image, in pixels, that will be decoded for hashing
+const MaxPixels = 50_000_000
+
+// ErrTooLarge is returned for images with more than MaxPixels pixels
+var ErrTooLarge = errors.New("image is too large to hash")
+
+// samples is the number of pixels sampled along each axis of a hash cell
+const samples = 8
+
+// DHashFile computes the difference hash of the image stored at path.
+// It returns image.ErrFormat if the file is not a supported image.
+func DHashFile(path string) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return 0, err
+	}
+	if config.Width*config.Height > MaxPixels {
+		return 0, ErrTooLarge
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return 0, err
+	}
+
+	return DHash(img), nil
+}
+
+// DHash computes the 64 bit difference hash of an image. The image is shrunk
+// to 9x8 grayscale cells, and each bit records whether a cell is brighter
+// than its right neighbour.
+func DHash(img image.Image) uint64 {
+	var cells [8][9]float64
+	bounds := img.Bounds()
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 9; x++ {
+			cells[y][x] = averageGray(img, image.Rect(
+				bounds.Min.X+x*bounds.Dx()/9,
+				bounds.Min.Y+y*bounds.Dy()/8,
+				bounds.Min.X+(x+1)*bounds.Dx()/9,
+				bounds.Min.Y+(y+1)*bounds.Dy()/8,
+			))
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if cells[y][x] > cells[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// averageGray returns the mean brightness of up to samples x samples evenly
+// spaced pixels within rect
+func averageGray(img image.Image, rect image.Rectangle) float64 {
+	if rect.Empty() {
+		// images narrower than the hash reuse the nearest pixel
+		rect.Max = rect.Min.Add(image.Pt(1, 1))
+	}
+
+	stepX := max(rect.Dx()/samples, 1)
+	stepY := max(rect.Dy()/samples, 1)
+
+	var sum float64
+	var count int
+	for y := rect.Min.Y; y < rect.Max.Y; y += stepY {
+		for x := rect.Min.X; x < rect.Max.X; x += stepX {
+			sum += float64(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+			count++
+		}
+	}
+	return sum / float64(count)
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Distance returns the Hamming distance between two hashes, the number of
+// bits that differ
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// Format encodes a hash as 16 hex characters
+func Format(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// Parse decodes a hash encoded by Format
+func Parse(str string) (uint64, error) {
+	if len(str) != 16 {
+		return 0, fmt.Errorf("invalid perceptual hash %#v", str)
+	}
+	return strconv.ParseUint(str, 16, 64)
+}
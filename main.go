@@ -2,13 +2,21 @@ package main
 
 import (
 	"flag"
+	"os"
 
+	"github.com/kiwiirc/plugin-fileuploader/cli"
 	"github.com/kiwiirc/plugin-fileuploader/server"
 )
 
 func main() {
 	var configPath = flag.String("config", "fileuploader.config.toml", "path to config file")
 	flag.Parse()
+
+	// run an offline admin command instead of the server when one is given
+	if flag.NArg() > 0 {
+		os.Exit(cli.Run(*configPath, flag.Args()))
+	}
+
 	runCtx := server.NewRunContext(nil, *configPath)
 	runCtx.Run()
 }
@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tus/tusd/cmd/tusd/cli/hooks"
+
+	"github.com/kiwiirc/plugin-fileuploader/events"
+)
+
+// CountTusEvents counts the uploads created, finished and terminated through
+// tusd, until the broadcaster is closed
+func CountTusEvents(broadcaster *events.TusEventBroadcaster) {
+	channel := broadcaster.Listen()
+	for event := range channel {
+		labels := UploaderLabels(event.Info.MetaData)
+		switch event.Type {
+		case hooks.HookPostCreate:
+			UploadsCreated.With(labels).Inc()
+		case hooks.HookPostFinish:
+			UploadsFinished.With(labels).Inc()
+		case hooks.HookPostTerminate:
+			UploadsTerminated.With(labels).Inc()
+		}
+	}
+}
+
+// GinMiddleware observes how long requests take, by the route that handled
+// them so that upload ids don't make a label each
+func GinMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		RequestDuration.
+			WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,194 @@
+// Package metrics defines the Prometheus metrics of the server. They live in
+// their own registry, which outlives the server instances replaced on config
+// reloads.
+package metrics
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "fileuploader"
+
+// labels identifying who made an upload
+var uploaderLabels = []string{"identity", "issuer"}
+
+// Registry holds every metric served by Handler
+var Registry = prometheus.NewRegistry()
+
+var (
+	UploadsCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "uploads_created_total",
+		Help:      "Uploads created.",
+	}, uploaderLabels)
+
+	UploadsFinished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "uploads_finished_total",
+		Help:      "Uploads whose content was fully received and accepted.",
+	}, uploaderLabels)
+
+	UploadsTerminated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "uploads_terminated_total",
+		Help:      "Uploads deleted by their uploader.",
+	}, uploaderLabels)
+
+	UploadsExpired = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "uploads_expired_total",
+		Help:      "Uploads deleted by the expirer.",
+	}, uploaderLabels)
+
+	UploadsEvicted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "uploads_evicted_total",
+		Help:      "Uploads deleted to free disk space, by whether they were active or trashed.",
+	}, []string{"state"})
+
+	UploadsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "uploads_rejected_total",
+		Help:      "Finished uploads refused by content checks, by reason.",
+	}, append(uploaderLabels, "reason"))
+
+	UploadsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "uploads_in_flight",
+		Help:      "Upload requests currently receiving content.",
+	})
+
+	BytesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "received_bytes_total",
+		Help:      "Upload content received.",
+	})
+
+	BytesServed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "served_bytes_total",
+		Help:      "Upload content sent to downloaders.",
+	})
+
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to handle HTTP requests, by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	GCDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "expirer_gc_duration_seconds",
+		Help:      "Time taken by expiry cycles.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 8),
+	})
+
+	GCItems = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "expirer_items_total",
+		Help:      "Uploads handled by expiry cycles, by what was done to them.",
+	}, []string{"action"})
+
+	DBQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Time taken by database statements.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 8),
+	}, []string{"operation"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		UploadsCreated,
+		UploadsFinished,
+		UploadsTerminated,
+		UploadsExpired,
+		UploadsEvicted,
+		UploadsRejected,
+		UploadsInFlight,
+		BytesReceived,
+		BytesServed,
+		RequestDuration,
+		GCDuration,
+		GCItems,
+		DBQueryDuration,
+		storage,
+	)
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// UploaderLabels returns the labels of an upload's metadata, which tell
+// anonymous uploads from those made with an account of an issuer
+func UploaderLabels(metadata map[string]string) prometheus.Labels {
+	if metadata["account"] == "" {
+		return prometheus.Labels{"identity": "anonymous", "issuer": ""}
+	}
+	return prometheus.Labels{"identity": "identified", "issuer": metadata["issuer"]}
+}
+
+// RejectionLabels returns the labels of an upload rejected for reason
+func RejectionLabels(metadata map[string]string, reason string) prometheus.Labels {
+	labels := UploaderLabels(metadata)
+	labels["reason"] = reason
+	return labels
+}
+
+// StorageFunc returns the bytes of the uploads in storage, counting each
+// upload (logical) and each distinct file (deduplicated)
+type StorageFunc func() (logical, deduplicated int64, err error)
+
+// storageCollector reports the size of the storage of the running server,
+// computed when scraped
+type storageCollector struct {
+	mu   sync.Mutex
+	fn   StorageFunc
+	desc *prometheus.Desc
+}
+
+var storage = &storageCollector{
+	desc: prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "storage_bytes"),
+		"Size of the uploads in storage, counting duplicates (logical) or not (deduplicated).",
+		[]string{"kind"}, nil,
+	),
+}
+
+// SetStorageFunc sets how the storage size is computed, when a server starts
+func SetStorageFunc(fn StorageFunc) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	storage.fn = fn
+}
+
+func (collector *storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- collector.desc
+}
+
+func (collector *storageCollector) Collect(ch chan<- prometheus.Metric) {
+	collector.mu.Lock()
+	fn := collector.fn
+	collector.mu.Unlock()
+	if fn == nil {
+		return
+	}
+
+	logical, deduplicated, err := fn()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(collector.desc, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(collector.desc, prometheus.GaugeValue, float64(logical), "logical")
+	ch <- prometheus.MustNewConstMetric(collector.desc, prometheus.GaugeValue, float64(deduplicated), "deduplicated")
+}
@@ -0,0 +1,423 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/kiwiirc/plugin-fileuploader/bans"
+	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+const (
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+)
+
+func (serv *UploadServer) registerAdminHandlers(r *gin.Engine) error {
+	if len(serv.cfg.Admin.ApiKeys) == 0 && serv.cfg.Admin.JwtIssuer == "" {
+		// admin API is disabled
+		return nil
+	}
+
+	routePrefix, err := routePrefixFromBasePath(serv.cfg.Server.BasePath)
+	if err != nil {
+		return err
+	}
+
+	rg := r.Group(path.Join(routePrefix, "admin"))
+	rg.Use(customizedCors(serv))
+	rg.Use(serv.adminAuthMiddleware())
+
+	rg.GET("uploads", serv.searchUploads())
+	rg.POST("uploads/delete", serv.deleteUploads())
+	rg.GET("uploads/:id", serv.showUpload())
+	rg.GET("uploads/:id/history", serv.uploaderHistory())
+	rg.POST("uploads/:id/restore", serv.restoreUpload())
+	rg.POST("uploads/:id/quarantine", serv.quarantineUpload(true))
+	rg.POST("uploads/:id/unquarantine", serv.quarantineUpload(false))
+	rg.POST("uploads/:id/expiry", serv.setUploadExpiry())
+
+	rg.GET("bans", serv.listBans())
+	rg.POST("bans", serv.createBan())
+	rg.DELETE("bans/:id", serv.deleteBan())
+
+	return nil
+}
+
+// adminAuthMiddleware accepts requests bearing an admin API key or admin JWT,
+// storing the name of the admin in the context for logging
+func (serv *UploadServer) adminAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := strings.TrimPrefix(c.Request.Header.Get("Authorization"), "Bearer ")
+		if key == "" {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		for i, allowed := range serv.cfg.Admin.ApiKeys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(allowed)) == 1 {
+				c.Set("admin", fmt.Sprintf("api-key-%d", i))
+				return
+			}
+		}
+
+		if serv.cfg.Admin.JwtIssuer != "" {
+			subject, err := serv.parseAdminJwt(key)
+			if err == nil {
+				c.Set("admin", subject)
+				return
+			}
+			c.Error(err).SetType(gin.ErrorTypePrivate)
+		}
+
+		c.Error(errors.New("Invalid admin credentials")).SetType(gin.ErrorTypePublic)
+		c.AbortWithStatus(http.StatusUnauthorized)
+	}
+}
+
+// parseAdminJwt validates an admin JWT and returns its subject
+func (serv *UploadServer) parseAdminJwt(tokenString string) (string, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		if serv.cfg.Admin.JwtSecret == "" {
+			// an empty key would accept tokens signed by anyone
+			return nil, errors.New("Admin JWT secret is not set")
+		}
+		return []byte(serv.cfg.Admin.JwtSecret), nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return "", errors.New("invalid admin jwt")
+	}
+	if !claims.VerifyIssuer(serv.cfg.Admin.JwtIssuer, true) {
+		return "", errors.New("Admin JWT has the wrong issuer")
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return "", errors.New("Admin JWT has no expiry")
+	}
+
+	subject, _ := claims["sub"].(string)
+	return "jwt:" + subject, nil
+}
+
+// logAdminAction records which admin changed an upload
+func (serv *UploadServer) logAdminAction(c *gin.Context, action, id string) {
+	serv.log.Info().
+		Str("event", "admin_action").
+		Str("admin", c.GetString("admin")).
+		Str("action", action).
+		Str("id", id).
+		Msg("Admin changed upload")
+}
+
+// searchUploads responds with the uploads matching the query parameters
+func (serv *UploadServer) searchUploads() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter, err := parseUploadFilter(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		records, err := serv.store.SearchUploads(filter)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"uploads": records})
+	}
+}
+
+// parseUploadFilter reads a search from the query parameters id, ip (an
+// address or CIDR range), account, issuer, sha256, type, min_size, from, to,
+// deleted, sort (newest or size), limit and offset
+func parseUploadFilter(c *gin.Context) (filter shardedfilestore.UploadFilter, err error) {
+	filter.ID = c.Query("id")
+	filter.Account = c.Query("account")
+	filter.Issuer = c.Query("issuer")
+	filter.Filetype = c.Query("type")
+	filter.IncludeDeleted = c.Query("deleted") == "true"
+
+	switch c.DefaultQuery("sort", "newest") {
+	case "newest":
+	case "size":
+		filter.LargestFirst = true
+	default:
+		return filter, errors.New("Invalid sort")
+	}
+
+	if minSize := c.Query("min_size"); minSize != "" {
+		filter.MinSize, err = strconv.ParseInt(minSize, 10, 64)
+		if err != nil || filter.MinSize < 0 {
+			return filter, errors.New("Invalid min_size")
+		}
+	}
+
+	if ip := c.Query("ip"); ip != "" {
+		filter.IPNet, err = bans.ParseIPRange(ip)
+		if err != nil {
+			return filter, err
+		}
+	}
+
+	if hash := c.Query("sha256"); hash != "" {
+		filter.SHA256, err = hex.DecodeString(hash)
+		if err != nil || len(filter.SHA256) != 32 {
+			return filter, errors.New("Invalid sha256")
+		}
+	}
+
+	if from := c.Query("from"); from != "" {
+		filter.CreatedAfter, err = parseAdminTime(from)
+		if err != nil {
+			return filter, errors.New("Invalid from")
+		}
+	}
+	if to := c.Query("to"); to != "" {
+		filter.CreatedBefore, err = parseAdminTime(to)
+		if err != nil {
+			return filter, errors.New("Invalid to")
+		}
+	}
+
+	filter.Limit = defaultSearchLimit
+	if limit := c.Query("limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit <= 0 {
+			return filter, errors.New("Invalid limit")
+		}
+	}
+	if filter.Limit > maxSearchLimit {
+		filter.Limit = maxSearchLimit
+	}
+
+	if offset := c.Query("offset"); offset != "" {
+		filter.Offset, err = strconv.Atoi(offset)
+		if err != nil || filter.Offset < 0 {
+			return filter, errors.New("Invalid offset")
+		}
+	}
+
+	return filter, nil
+}
+
+// parseAdminTime parses a unix timestamp or RFC 3339 time
+func parseAdminTime(str string) (int64, error) {
+	if unix, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return unix, nil
+	}
+	t, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return 0, err
+	}
+	return t.Unix(), nil
+}
+
+// showUpload responds with an upload and the abuse reports about it
+func (serv *UploadServer) showUpload() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		record, err := serv.store.GetUploadRecord(c.Param("id"))
+		if err == tusd.ErrNotFound {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		} else if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+			return
+		}
+
+		reports, err := serv.store.Reports(record.ID)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"upload":  record,
+			"reports": reports,
+		})
+	}
+}
+
+// uploaderHistory responds with every upload, including deleted ones, made by
+// the uploader of an upload. Identified uploaders are matched by account and
+// anonymous ones by IP address.
+func (serv *UploadServer) uploaderHistory() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		record, err := serv.store.GetUploadRecord(c.Param("id"))
+		if err == tusd.ErrNotFound {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		} else if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+			return
+		}
+
+		filter := shardedfilestore.UploadFilter{IncludeDeleted: true}
+		if record.JwtAccount != "" {
+			filter.Account = record.JwtAccount
+			filter.Issuer = record.JwtIssuer
+		} else if record.UploaderIP != "" {
+			filter.IPNet, err = bans.ParseIPRange(record.UploaderIP)
+			if err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+				return
+			}
+		} else {
+			filter.ID = record.ID
+		}
+
+		records, err := serv.store.SearchUploads(filter)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"uploads": records})
+	}
+}
+
+// deleteUploads terminates every upload in a JSON body of the form
+// {"ids": ["<id>", ...]}, responding with the ids deleted and the errors
+// for the others
+func (serv *UploadServer) deleteUploads() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			IDs []string `json:"ids"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || len(body.IDs) == 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, "Expected a list of ids")
+			return
+		}
+
+		deleted := make([]string, 0, len(body.IDs))
+		failed := make(map[string]string)
+		for _, id := range body.IDs {
+			record, err := serv.store.GetUploadRecord(id)
+			if err == tusd.ErrNotFound {
+				failed[id] = "not found"
+				continue
+			} else if err != nil {
+				c.Error(err).SetType(gin.ErrorTypePrivate)
+				failed[id] = "internal error"
+				continue
+			}
+			if record.Deleted {
+				failed[id] = "already deleted"
+				continue
+			}
+
+			if err := serv.store.Terminate(id); err != nil {
+				c.Error(err).SetType(gin.ErrorTypePrivate)
+				failed[id] = "internal error"
+				continue
+			}
+			serv.logAdminAction(c, "delete", id)
+			deleted = append(deleted, id)
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"deleted": deleted,
+			"errors":  failed,
+		})
+	}
+}
+
+func (serv *UploadServer) restoreUpload() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := serv.store.Restore(c.Param("id"))
+		switch err {
+		case nil:
+			serv.logAdminAction(c, "restore", c.Param("id"))
+			c.Status(http.StatusNoContent)
+		case tusd.ErrNotFound:
+			c.AbortWithStatus(http.StatusNotFound)
+		case shardedfilestore.ErrNotTrashed, shardedfilestore.ErrUnfinished:
+			c.AbortWithStatusJSON(http.StatusConflict, err.Error())
+		case shardedfilestore.ErrPurged:
+			c.AbortWithStatusJSON(http.StatusGone, err.Error())
+		default:
+			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		}
+	}
+}
+
+func (serv *UploadServer) quarantineUpload(quarantine bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		action := "quarantine"
+		var err error
+		if quarantine {
+			err = serv.store.Quarantine(id)
+		} else {
+			action = "unquarantine"
+			err = serv.store.Unquarantine(id)
+		}
+
+		if serv.abortOnUploadError(c, err) {
+			return
+		}
+		serv.logAdminAction(c, action, id)
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// setUploadExpiry changes when an upload expires, to the time given by the
+// "expires" form value or after the duration given by "ttl"
+func (serv *UploadServer) setUploadExpiry() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var expires int64
+		var err error
+		if ttlStr := c.Request.FormValue("ttl"); ttlStr != "" {
+			var ttl time.Duration
+			ttl, err = time.ParseDuration(ttlStr)
+			expires = time.Now().Add(ttl).Unix()
+		} else {
+			expires, err = parseAdminTime(c.Request.FormValue("expires"))
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, "Invalid expires or ttl")
+			return
+		}
+
+		id := c.Param("id")
+		err = serv.store.SetExpiry(id, expires)
+		if serv.abortOnUploadError(c, err) {
+			return
+		}
+		serv.logAdminAction(c, "set_expiry", id)
+		c.JSON(http.StatusOK, gin.H{"expires": expires})
+	}
+}
+
+// abortOnUploadError responds with the status matching an error from changing
+// an upload, and returns whether there was an error
+func (serv *UploadServer) abortOnUploadError(c *gin.Context, err error) bool {
+	switch err {
+	case nil:
+		return false
+	case tusd.ErrNotFound:
+		c.AbortWithStatus(http.StatusNotFound)
+	case shardedfilestore.ErrUploadGone:
+		c.AbortWithStatus(http.StatusGone)
+	default:
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+	}
+	return true
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kiwiirc/plugin-fileuploader/bans"
+	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
+)
+
+// enforceBans refuses requests from banned users. Requests creating uploads
+// are matched by IP address and the account in metadata, PATCH requests by IP
+// address and the account that created the upload, and every other request
+// about an existing upload, such as downloads, password prompts, signing and
+// reports, by IP address when downloads are enforced. It responds to the
+// request and returns false if it is banned.
+func (serv *UploadServer) enforceBans(c *gin.Context, metadata map[string]string) bool {
+	var ip, account, issuer string
+
+	switch c.Request.Method {
+	case "POST":
+		if c.Param("id") == "" {
+			ip = metadata["RemoteIP"]
+			account = metadata["account"]
+			issuer = metadata["issuer"]
+			break
+		}
+		if !serv.cfg.Bans.EnforceOnDownloads {
+			return true
+		}
+		ip = metadata["RemoteIP"]
+	case "PATCH":
+		ip, _ = serv.getDirectOrForwardedRemoteIP(c.Request)
+		row := serv.DBConn.DB.QueryRow(serv.DBConn.DB.Rebind(`SELECT jwt_account, jwt_issuer FROM uploads WHERE id = ?`), c.Param("id"))
+		err := row.Scan(&account, &issuer)
+		if err != nil && err != sql.ErrNoRows {
+			c.Error(err).SetType(gin.ErrorTypePrivate)
+		}
+	case "GET", "HEAD":
+		if !serv.cfg.Bans.EnforceOnDownloads {
+			return true
+		}
+		ip, _ = serv.getDirectOrForwardedRemoteIP(c.Request)
+	default:
+		return true
+	}
+
+	ban, err := serv.bans.Match(ip, account, issuer)
+	if err != nil {
+		serv.log.Error().
+			Err(err).
+			Bool("fail_open", serv.cfg.Bans.FailOpen).
+			Msg("Failed to load bans")
+		if serv.cfg.Bans.FailOpen {
+			return true
+		}
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, "Could not check bans, try again later")
+		return false
+	}
+	if ban == nil {
+		return true
+	}
+
+	serv.log.Warn().
+		Str("event", "ban_enforced").
+		Str("ban_id", ban.ID).
+		Str("method", c.Request.Method).
+		Str("ip", ip).
+		Str("account", account).
+		Str("issuer", issuer).
+		Msg("Refused request from banned user")
+
+	c.AbortWithStatusJSON(http.StatusForbidden, "Banned")
+	return false
+}
+
+func (serv *UploadServer) listBans() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		all, err := serv.bans.All()
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"bans": all})
+	}
+}
+
+// createBan adds a ban from a JSON body such as
+// {"ip": "192.0.2.0/24", "reason": "spam", "ttl": "72h", "terminate": true}.
+// Instead of "ip" a ban can have an "account" and "issuer", or only an
+// "issuer". With "terminate" set the existing uploads of the banned party are
+// deleted.
+func (serv *UploadServer) createBan() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			IP        string `json:"ip"`
+			Account   string `json:"account"`
+			Issuer    string `json:"issuer"`
+			Reason    string `json:"reason"`
+			Ttl       string `json:"ttl"`
+			Expires   string `json:"expires"`
+			Terminate bool   `json:"terminate"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, "Invalid ban")
+			return
+		}
+		if (body.IP == "") == (body.Issuer == "") || (body.Account != "" && body.Issuer == "") {
+			c.AbortWithStatusJSON(http.StatusBadRequest, "A ban needs either an ip, an account and issuer, or an issuer")
+			return
+		}
+
+		ban := &bans.Ban{
+			ID:        shardedfilestore.Uid(),
+			IPRange:   body.IP,
+			Account:   body.Account,
+			Issuer:    body.Issuer,
+			Reason:    body.Reason,
+			CreatedBy: c.GetString("admin"),
+			CreatedAt: time.Now().Unix(),
+		}
+
+		if body.Ttl != "" {
+			ttl, err := time.ParseDuration(body.Ttl)
+			if err != nil || ttl <= 0 {
+				c.AbortWithStatusJSON(http.StatusBadRequest, "Invalid ttl")
+				return
+			}
+			expires := time.Now().Add(ttl).Unix()
+			ban.ExpiresAt = &expires
+		} else if body.Expires != "" {
+			expires, err := parseAdminTime(body.Expires)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, "Invalid expires")
+				return
+			}
+			ban.ExpiresAt = &expires
+		}
+
+		if ban.IPRange != "" {
+			if _, err := bans.ParseIPRange(ban.IPRange); err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+
+		err := serv.bans.Add(ban)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+			return
+		}
+
+		serv.log.Info().
+			Str("event", "ban_added").
+			Str("admin", ban.CreatedBy).
+			Str("ban_id", ban.ID).
+			Str("ip_range", ban.IPRange).
+			Str("account", ban.Account).
+			Str("issuer", ban.Issuer).
+			Str("reason", ban.Reason).
+			Msg("Added ban")
+
+		terminated := 0
+		if body.Terminate {
+			terminated, err = serv.terminateBanned(c, ban)
+			if err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+				return
+			}
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"ban":        ban,
+			"terminated": terminated,
+		})
+	}
+}
+
+// terminateBanned deletes the existing uploads covered by a ban
+func (serv *UploadServer) terminateBanned(c *gin.Context, ban *bans.Ban) (int, error) {
+	filter := shardedfilestore.UploadFilter{
+		IPNet:   ban.IPNet(),
+		Account: ban.Account,
+		Issuer:  ban.Issuer,
+	}
+	records, err := serv.store.SearchUploads(filter)
+	if err != nil {
+		return 0, err
+	}
+
+	terminated := 0
+	for _, record := range records {
+		if err := serv.store.Terminate(record.ID); err != nil {
+			return terminated, err
+		}
+		serv.logAdminAction(c, "delete", record.ID)
+		terminated++
+	}
+	return terminated, nil
+}
+
+func (serv *UploadServer) deleteBan() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := serv.bans.Remove(c.Param("id"))
+		if err == bans.ErrNotFound {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		} else if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+			return
+		}
+
+		serv.log.Info().
+			Str("event", "ban_removed").
+			Str("admin", c.GetString("admin")).
+			Str("ban_id", c.Param("id")).
+			Msg("Removed ban")
+
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
+)
+
+// states of a RunContext, readiness fails in all but stateReady
+const (
+	stateStarting int32 = iota
+	stateReady
+	stateReloading
+	stateShuttingDown
+)
+
+var stateNames = map[int32]string{
+	stateStarting:     "starting",
+	stateReady:        "ready",
+	stateReloading:    "reloading",
+	stateShuttingDown: "shutting_down",
+}
+
+// healthCheckTimeout bounds the database query of a health check
+const healthCheckTimeout = 5 * time.Second
+
+func (runCtx *RunContext) setState(state int32) {
+	atomic.StoreInt32(&runCtx.state, state)
+}
+
+func (runCtx *RunContext) getState() int32 {
+	return atomic.LoadInt32(&runCtx.state)
+}
+
+// drain keeps the current server serving for delay while readiness checks
+// fail, so that load balancers stop sending it requests before its listener
+// closes
+func (runCtx *RunContext) drain(delay time.Duration, event, doing string) {
+	if delay <= 0 {
+		return
+	}
+	runCtx.log.Info().
+		Str("event", event).
+		Dur("delay", delay).
+		Msg("Failing readiness checks before " + doing)
+	time.Sleep(delay)
+}
+
+type healthReport struct {
+	Status    string                      `json:"status"`
+	State     string                      `json:"state,omitempty"`
+	Checks    map[string]string           `json:"checks"`
+	DiskSpace *shardedfilestore.DiskSpace `json:"disk_space,omitempty"`
+}
+
+// registerHealthHandlers serves <BasePath>/healthz, which checks that the
+// database and storage are usable, and <BasePath>/readyz, which also fails
+// while the server is reloading or shutting down so that load balancers
+// stop sending it requests first
+func (serv *UploadServer) registerHealthHandlers(r *gin.Engine) error {
+	routePrefix, err := routePrefixFromBasePath(serv.cfg.Server.BasePath)
+	if err != nil {
+		return err
+	}
+
+	r.GET(path.Join(routePrefix, "healthz"), func(c *gin.Context) {
+		report := serv.checkHealth(c.Request.Context())
+		serv.sendHealthReport(c, report)
+	})
+
+	r.GET(path.Join(routePrefix, "readyz"), func(c *gin.Context) {
+		report := serv.checkHealth(c.Request.Context())
+		state := stateReady
+		if serv.runCtx != nil {
+			state = serv.runCtx.getState()
+		}
+		report.State = stateNames[state]
+		if state != stateReady {
+			report.Status = "failing"
+		}
+		serv.sendHealthReport(c, report)
+	})
+
+	return nil
+}
+
+// checkHealth checks the database and storage. The errors are logged rather
+// than reported, as they may reveal paths and addresses.
+func (serv *UploadServer) checkHealth(ctx context.Context) *healthReport {
+	report := &healthReport{
+		Status: "ok",
+		Checks: make(map[string]string),
+	}
+	fail := func(check string, err error) {
+		serv.log.Error().
+			Err(err).
+			Str("event", "health_check_failed").
+			Str("check", check).
+			Msg("Health check failed")
+		report.Checks[check] = "failing"
+		report.Status = "failing"
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	if err := serv.store.Ping(ctx); err != nil {
+		fail("database", err)
+	} else {
+		report.Checks["database"] = "ok"
+	}
+
+	failed := serv.store.CheckWritable()
+	for _, dir := range []string{"incomplete", "complete"} {
+		if err, ok := failed[dir]; ok {
+			fail(dir, err)
+		} else {
+			report.Checks[dir] = "ok"
+		}
+	}
+
+	space, err := serv.store.DiskSpace()
+	switch {
+	case err == nil:
+		report.Checks["disk_space"] = "ok"
+		report.DiskSpace = space
+	case errors.Is(err, shardedfilestore.ErrDiskSpaceUnsupported):
+	default:
+		fail("disk_space", err)
+	}
+
+	return report
+}
+
+func (serv *UploadServer) sendHealthReport(c *gin.Context, report *healthReport) {
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(status, report)
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"path"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/kiwiirc/plugin-fileuploader/config"
+	"github.com/kiwiirc/plugin-fileuploader/metrics"
+)
+
+// registerMetricsHandler serves the Prometheus metrics at <BasePath>/metrics,
+// unless they are served on their own listener
+func (serv *UploadServer) registerMetricsHandler(r *gin.Engine) error {
+	if !serv.cfg.Metrics.Enabled || serv.cfg.Metrics.ListenAddress != "" {
+		return nil
+	}
+
+	routePrefix, err := routePrefixFromBasePath(serv.cfg.Server.BasePath)
+	if err != nil {
+		return err
+	}
+
+	r.GET(path.Join(routePrefix, "metrics"), gin.WrapH(metrics.Handler()))
+	return nil
+}
+
+// countReceived counts the upload requests in progress and the content they
+// receive
+func countReceived(next gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		metrics.UploadsInFlight.Inc()
+		defer metrics.UploadsInFlight.Dec()
+
+		c.Request.Body = countingBody{c.Request.Body}
+		next(c)
+	}
+}
+
+// countingBody adds the bytes read from a request body to the received bytes
+type countingBody struct {
+	io.ReadCloser
+}
+
+func (body countingBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	metrics.BytesReceived.Add(float64(n))
+	return n, err
+}
+
+// updateMetricsListener starts, moves or stops the listener serving the
+// metrics on their own address to match the config. It stays open across
+// config reloads that keep the same address.
+func (runCtx *RunContext) updateMetricsListener(cfg *config.Config) {
+	address := ""
+	if cfg.Metrics.Enabled {
+		address = cfg.Metrics.ListenAddress
+	}
+	if runCtx.metricsServer != nil {
+		if runCtx.metricsServer.Addr == address {
+			return
+		}
+		runCtx.metricsServer.Close()
+		runCtx.metricsServer = nil
+	}
+	if address == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	server := &http.Server{
+		Addr:    address,
+		Handler: mux,
+	}
+	runCtx.metricsServer = server
+
+	log := runCtx.log
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Error().
+				Err(err).
+				Str("event", "metrics_listener_failed").
+				Str("address", address).
+				Msg("Failed to serve metrics")
+		}
+	}()
+
+	log.Info().
+		Str("event", "metrics_listening").
+		Str("address", address).
+		Msg("Serving metrics")
+}
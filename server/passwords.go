@@ -0,0 +1,116 @@
+package server
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcrypt ignores anything past the first 72 bytes of a password
+const maxPasswordLength = 72
+
+var passwordPromptTemplate = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Password required</title>
+<style>
+body { font-family: sans-serif; display: flex; justify-content: center; margin-top: 20vh; }
+form { display: flex; flex-direction: column; gap: 0.5em; }
+.error { color: #c00; }
+</style>
+</head>
+<body>
+<form method="POST">
+<label for="password">This file is password protected</label>
+{{if .}}<span class="error">{{.}}</span>{{end}}
+<input type="password" id="password" name="password" autofocus required>
+<button type="submit">Download</button>
+</form>
+</body>
+</html>
+`))
+
+// hashPassword replaces the plaintext password in the metadata with its hash
+func hashPassword(metadata map[string]string) error {
+	password, ok := metadata["password"]
+	if !ok {
+		return nil
+	}
+	delete(metadata, "password")
+
+	if password == "" {
+		return nil
+	}
+	if len(password) > maxPasswordLength {
+		return errors.New("Password too long")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	metadata["PasswordHash"] = string(hash)
+	return nil
+}
+
+// checkDownloadPassword ensures the password of a protected upload was given,
+// either by basic auth or by the password prompt form. It responds to the
+// request and returns false if the download should not go ahead.
+func (serv *UploadServer) checkDownloadPassword(c *gin.Context, passwordHash string) bool {
+	password := c.Request.PostFormValue("password")
+	if _, basicPassword, ok := c.Request.BasicAuth(); ok {
+		password = basicPassword
+	}
+	if password == "" {
+		serv.promptForPassword(c, http.StatusUnauthorized, "")
+		return false
+	}
+
+	remoteIP, err := serv.getDirectOrForwardedRemoteIP(c.Request)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return false
+	}
+
+	if !serv.passwordLimiter.Allowed(remoteIP) {
+		serv.promptForPassword(c, http.StatusTooManyRequests, "Too many failed attempts, try again later")
+		return false
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password))
+	if err != nil {
+		serv.passwordLimiter.Hit(remoteIP)
+		serv.log.Warn().
+			Str("event", "password_failed").
+			Str("id", c.Param("id")).
+			Str("ip", remoteIP).
+			Msg("Incorrect download password")
+		serv.promptForPassword(c, http.StatusUnauthorized, "Incorrect password")
+		return false
+	}
+
+	return true
+}
+
+func (serv *UploadServer) promptForPassword(c *gin.Context, status int, message string) {
+	if !strings.Contains(c.GetHeader("Accept"), "text/html") {
+		c.Header("WWW-Authenticate", `Basic realm="Password protected file", charset="UTF-8"`)
+		c.AbortWithStatus(status)
+		return
+	}
+
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Header("Cache-Control", "no-store")
+	c.Status(status)
+	err := passwordPromptTemplate.Execute(c.Writer, message)
+	if err != nil {
+		c.Error(err).SetType(gin.ErrorTypePrivate)
+	}
+	c.Abort()
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter counts events per key, such as failed attempts per IP address,
+// within a fixed time window
+type rateLimiter struct {
+	mu        sync.Mutex
+	limit     int
+	window    time.Duration
+	entries   map[string]*rateLimitEntry
+	lastPrune time.Time
+}
+
+type rateLimitEntry struct {
+	count int
+	start time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:     limit,
+		window:    window,
+		entries:   make(map[string]*rateLimitEntry),
+		lastPrune: time.Now(),
+	}
+}
+
+// Allowed reports whether key has not yet reached the limit in the current window
+func (l *rateLimiter) Allowed(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.entries[key]
+	if !ok || time.Since(entry.start) >= l.window {
+		return true
+	}
+	return entry.count < l.limit
+}
+
+// Hit records an event for key
+func (l *rateLimiter) Hit(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+
+	entry, ok := l.entries[key]
+	if !ok || now.Sub(entry.start) >= l.window {
+		entry = &rateLimitEntry{start: now}
+		l.entries[key] = entry
+	}
+	entry.count++
+}
+
+// prune removes entries whose window has passed, at most once per window
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < l.window {
+		return
+	}
+	l.lastPrune = now
+
+	for key, entry := range l.entries {
+		if now.Sub(entry.start) >= l.window {
+			delete(l.entries, key)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	tusd "github.com/tus/tusd/pkg/handler"
+
+	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
+)
+
+// reportUpload stores an abuse report about an upload, and quarantines the
+// upload once enough different people have reported it
+func (serv *UploadServer) reportUpload() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		metadata := c.MustGet("metadata").(map[string]string)
+		remoteIP := metadata["RemoteIP"]
+
+		reason := strings.TrimSpace(c.Request.FormValue("reason"))
+		if reason == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, "Missing reason")
+			return
+		}
+		if len(reason) > serv.cfg.Reports.MaxReasonLength {
+			c.AbortWithStatusJSON(http.StatusBadRequest, "Reason too long")
+			return
+		}
+
+		if !serv.reportLimiter.Allowed(remoteIP) {
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, "Too many reports, try again later")
+			return
+		}
+		serv.reportLimiter.Hit(remoteIP)
+
+		report := &shardedfilestore.Report{
+			UploadID:        c.Param("id"),
+			ReporterIP:      remoteIP,
+			ReporterAccount: metadata["account"],
+			ReporterIssuer:  metadata["issuer"],
+			Reason:          reason,
+		}
+		reporters, quarantined, err := serv.store.AddReport(report, serv.cfg.Reports.QuarantineThreshold)
+		if err == tusd.ErrNotFound {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		} else if err == shardedfilestore.ErrUploadGone {
+			c.AbortWithStatus(http.StatusGone)
+			return
+		} else if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+			return
+		}
+
+		serv.log.Info().
+			Str("event", "upload_reported").
+			Str("id", report.UploadID).
+			Str("report_id", report.ID).
+			Str("ip", remoteIP).
+			Str("account", report.ReporterAccount).
+			Str("issuer", report.ReporterIssuer).
+			Str("reason", reason).
+			Int("reporters", reporters).
+			Msg("Upload reported")
+
+		if quarantined {
+			serv.log.Warn().
+				Str("event", "report_threshold_reached").
+				Str("id", report.UploadID).
+				Int("reporters", reporters).
+				Msg("Quarantined reported upload")
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"id": report.ID})
+	}
+}
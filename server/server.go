@@ -21,6 +21,8 @@ type RunContext struct {
 	reloadSignals   chan os.Signal
 	shutdownSignals chan os.Signal
 	log             *zerolog.Logger
+	metricsServer   *http.Server
+	state           int32 // accessed atomically, see setState
 }
 
 func NewRunContext(parentRouter *http.ServeMux, configPath string) *RunContext {
@@ -77,7 +79,7 @@ func (runCtx *RunContext) runLoop() {
 
 	for {
 		// new server instance
-		serv := UploadServer{}
+		serv := UploadServer{runCtx: runCtx}
 		cfg := config.NewConfig()
 
 		// refresh config
@@ -99,6 +101,8 @@ func (runCtx *RunContext) runLoop() {
 		runCtx.log.Info().Str("path", runCtx.configPath).Msg("Loaded config file")
 		cfg.DoPostLoadLogging(runCtx.log, runCtx.configPath, md)
 
+		runCtx.updateMetricsListener(cfg)
+
 		// register handler on parentRouter if any, when prefix has not been previously registered
 		if runCtx.parentRouter != nil {
 			routePrefix, err := routePrefixFromBasePath(serv.cfg.Server.BasePath)
@@ -128,14 +132,21 @@ func (runCtx *RunContext) runLoop() {
 			}
 		}()
 
-		// wait for startup to complete
-		<-serv.GetStartedChan()
+		// wait for startup to complete, or fail
+		select {
+		case <-serv.GetStartedChan():
+		case err := <-errChan:
+			runCtx.log.Fatal().
+				Err(err).
+				Msg("Error starting upload server")
+		}
 		if runCtx.parentRouter == nil {
 			runCtx.log.Info().
 				Str("event", "startup").
 				Str("address", serv.cfg.Server.ListenAddress).
 				Msg("Server listening")
 		}
+		runCtx.setState(stateReady)
 
 		// wait for error or reload request
 		shouldRestart := func() bool {
@@ -153,6 +164,9 @@ func (runCtx *RunContext) runLoop() {
 				return true
 
 			case <-runCtx.reloadSignals:
+				runCtx.setState(stateReloading)
+				runCtx.drain(serv.cfg.Server.DrainDelay.Duration, "reload_draining", "reloading")
+
 				// Run in separate goroutine so we don't wait for .Shutdown()
 				// to return before starting the new server.
 				// This allows us to handle outstanding requests using the old
@@ -164,9 +178,18 @@ func (runCtx *RunContext) runLoop() {
 						Msg("Reloading server config")
 					serv.Shutdown()
 				}()
+
+				// wait for the old server to close its listener, so that the
+				// new one can bind the same address
+				if runCtx.parentRouter == nil {
+					<-errChan
+				}
 				return true
 
 			case <-runCtx.shutdownSignals:
+				runCtx.setState(stateShuttingDown)
+				runCtx.drain(serv.cfg.Server.DrainDelay.Duration, "shutdown_draining", "shutting down")
+
 				runCtx.log.Info().
 					Str("event", "shutdown_started").
 					Msg("Shutdown initiated. Handling existing requests")
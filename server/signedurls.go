@@ -0,0 +1,112 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// signDownload returns the query string authorizing downloads of a private
+// upload until the expiry time, signed with the current signing key
+func (serv *UploadServer) signDownload(id string, expires int64) (url.Values, error) {
+	keyID := serv.cfg.SignedUrls.SigningKey
+	secret, ok := serv.cfg.SignedUrls.Keys[keyID]
+	if keyID == "" || !ok {
+		return nil, errors.New("Signing key not configured")
+	}
+
+	expiresStr := strconv.FormatInt(expires, 10)
+	return url.Values{
+		"expires": {expiresStr},
+		"kid":     {keyID},
+		"sig":     {downloadSignature(secret, id, expiresStr)},
+	}, nil
+}
+
+func downloadSignature(secret, id, expires string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(id + ":" + expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkDownloadSignature ensures a private upload is requested with a valid,
+// unexpired signature made with any of the configured keys. It responds to the
+// request and returns false if the download should not go ahead.
+func (serv *UploadServer) checkDownloadSignature(c *gin.Context) bool {
+	query := c.Request.URL.Query()
+	expiresStr := query.Get("expires")
+	secret, ok := serv.cfg.SignedUrls.Keys[query.Get("kid")]
+
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if !ok || err != nil || expires < time.Now().Unix() {
+		c.AbortWithStatus(http.StatusForbidden)
+		return false
+	}
+
+	expected := downloadSignature(secret, c.Param("id"), expiresStr)
+	if !hmac.Equal([]byte(expected), []byte(query.Get("sig"))) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// signUpload responds with a signed download URL for the requesting owner's upload
+func (serv *UploadServer) signUpload() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !serv.authorizeOwner(c) {
+			return
+		}
+
+		ttl := serv.cfg.SignedUrls.DefaultTtl.Duration
+		if ttlStr := c.Request.FormValue("ttl"); ttlStr != "" {
+			var err error
+			ttl, err = time.ParseDuration(ttlStr)
+			if err != nil || ttl <= 0 {
+				c.AbortWithStatusJSON(http.StatusBadRequest, "Invalid ttl")
+				return
+			}
+		}
+		if ttl > serv.cfg.SignedUrls.MaxTtl.Duration {
+			ttl = serv.cfg.SignedUrls.MaxTtl.Duration
+		}
+
+		id := c.Param("id")
+		expires := time.Now().Add(ttl).Unix()
+		query, err := serv.signDownload(id, expires)
+		if err != nil {
+			c.AbortWithError(http.StatusNotImplemented, err).SetType(gin.ErrorTypePublic)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"url":     serv.uploadURL(c.Request, id) + "?" + query.Encode(),
+			"expires": expires,
+		})
+	}
+}
+
+// uploadURL returns the absolute download URL of an upload, using the host of
+// the request when BasePath is not an absolute URL
+func (serv *UploadServer) uploadURL(req *http.Request, id string) string {
+	basePath := strings.TrimSuffix(serv.cfg.Server.BasePath, "/") + "/" + id
+
+	if parsed, err := url.Parse(basePath); err == nil && parsed.IsAbs() {
+		return basePath
+	}
+
+	scheme := "http"
+	if req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host + basePath
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCheckDownloadSignature(t *testing.T) {
+	serv := &UploadServer{}
+	serv.cfg.SignedUrls.SigningKey = "new"
+	serv.cfg.SignedUrls.Keys = map[string]string{
+		"old": "old-secret",
+		"new": "new-secret",
+	}
+
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Hour).Unix()
+
+	tests := []struct {
+		name    string
+		id      string // id the request is made for
+		expires int64
+		keyID   string // key the URL is signed with
+		kid     string // key named in the URL, the signing key when empty
+		want    bool
+	}{
+		{"valid", "abc", future, "new", "", true},
+		{"rotated key", "abc", future, "old", "", true},
+		{"expired", "abc", past, "new", "", false},
+		{"unknown kid", "abc", future, "new", "missing", false},
+		{"wrong kid", "abc", future, "new", "old", false},
+		{"tampered id", "abd", future, "new", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			serv.cfg.SignedUrls.SigningKey = test.keyID
+			query, err := serv.signDownload("abc", test.expires)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.kid != "" {
+				query.Set("kid", test.kid)
+			}
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("GET", "/files/"+test.id+"?"+query.Encode(), nil)
+			c.Params = gin.Params{{Key: "id", Value: test.id}}
+
+			if got := serv.checkDownloadSignature(c); got != test.want {
+				t.Errorf("checkDownloadSignature() = %v, want %v", got, test.want)
+			}
+			if !test.want && w.Code != http.StatusForbidden {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func TestSignDownloadWithoutKey(t *testing.T) {
+	serv := &UploadServer{}
+	serv.cfg.SignedUrls.SigningKey = "missing"
+
+	if _, err := serv.signDownload("abc", time.Now().Unix()); err == nil {
+		t.Error("signDownload() succeeded without a configured key")
+	}
+}
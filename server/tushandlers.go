@@ -1,7 +1,10 @@
 package server
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -10,12 +13,15 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
 
+	"github.com/IGLOU-EU/go-wildcard"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/kiwiirc/plugin-fileuploader/events"
 	"github.com/kiwiirc/plugin-fileuploader/logging"
+	"github.com/kiwiirc/plugin-fileuploader/metrics"
 	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
 	tusd "github.com/tus/tusd/pkg/handler"
 )
@@ -50,6 +56,13 @@ func customizedCors(serv *UploadServer) gin.HandlerFunc {
 			}
 		}
 
+		// allow browser clients to read and send the deletion token
+		if c.Request.Method == "OPTIONS" {
+			respHeader.Add("Access-Control-Allow-Headers", deletionTokenHeader)
+		} else {
+			respHeader.Add("Access-Control-Expose-Headers", deletionTokenHeader)
+		}
+
 		// lets the user-agent know the response can vary depending on the origin of the request.
 		// ensures correct behaviour of browser cache.
 		respHeader.Add("Vary", "Origin")
@@ -60,13 +73,19 @@ func (serv *UploadServer) fileuploaderMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if c.Request.Method != "POST" && c.Request.Method != "DELETE" {
 			// Metadata is only required for POST and DELETE requests
+			serv.enforceBans(c, nil)
 			return
 		}
 
 		metadata := tusd.ParseMetadataHeader(c.Request.Header.Get("Upload-Metadata"))
 
-		// ensure the user does not try to provide their own RemoteIP
+		// ensure the user does not try to provide their own RemoteIP or secret hashes
 		delete(metadata, "RemoteIP")
+		delete(metadata, "DeletionTokenHash")
+		delete(metadata, "PasswordHash")
+		for _, key := range shardedfilestore.DerivedMetadata {
+			delete(metadata, key)
+		}
 
 		// determine the originating IP
 		remoteIP, err := serv.getDirectOrForwardedRemoteIP(c.Request)
@@ -96,6 +115,10 @@ func (serv *UploadServer) fileuploaderMiddleware() gin.HandlerFunc {
 		// extjwt is no longer needed, remove so it does not get stored with the file info
 		delete(metadata, "extjwt")
 
+		if c.Request.Method == "POST" && !serv.enforceBans(c, metadata) {
+			return
+		}
+
 		// Update metadata with any changes that have been made
 		c.Request.Header.Set("Upload-Metadata", tusd.SerializeMetadataHeader(metadata))
 
@@ -138,6 +161,9 @@ func (serv *UploadServer) registerTusHandlers(r *gin.Engine, store *shardedfiles
 	// attach logger
 	go logging.TusdLogger(serv.log, serv.tusEventBroadcaster)
 
+	// attach metrics
+	go metrics.CountTusEvents(serv.tusEventBroadcaster)
+
 	noopHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
 	tusdMiddleware := gin.WrapH(handler.Middleware(noopHandler))
 
@@ -150,15 +176,31 @@ func (serv *UploadServer) registerTusHandlers(r *gin.Engine, store *shardedfiles
 	// Register a dummy handler for OPTIONS, without this the middleware's would not be called
 	rg.OPTIONS("*any", gin.WrapH(noopHandler))
 
-	headFile := gin.WrapF(handler.HeadFile)
+	headFile := serv.headFile(handler)
 	rg.HEAD(":id", headFile)
 	rg.HEAD(":id/:filename", rewritePath(headFile, routePrefix))
 
-	getFile := gin.WrapF(handler.GetFile)
+	getFile := serv.getFile(handler)
 	rg.GET(":id", getFile)
 	rg.GET(":id/:filename", rewritePath(getFile, routePrefix))
 
-	patchFile := gin.WrapF(handler.PatchFile)
+	// Routes that are not part of the tus protocol are registered outside of
+	// the tusd middleware, which rejects non-tus requests
+	plainGroup := r.Group(routePrefix)
+	plainGroup.Use(customizedCors(serv))
+	plainGroup.Use(serv.fileuploaderMiddleware())
+
+	// the password prompt for protected uploads is submitted by POST
+	plainGroup.POST(":id", getFile)
+	plainGroup.POST(":id/:filename", rewritePath(getFile, routePrefix))
+
+	// owners of private uploads can request signed download URLs
+	plainGroup.POST(":id/sign", serv.signUpload())
+
+	// anyone can report an abusive upload
+	plainGroup.POST(":id/report", serv.reportUpload())
+
+	patchFile := countReceived(serv.guardPatch(gin.WrapF(handler.PatchFile)))
 	rg.PATCH(":id", patchFile)
 	rg.PATCH(":id/:filename", rewritePath(patchFile, routePrefix))
 
@@ -184,35 +226,254 @@ func (serv *UploadServer) postFile(handler *tusd.UnroutedHandler) gin.HandlerFun
 			}
 		}
 
+		if serv.diskGuard != nil {
+			// uploads with a deferred length are admitted chunk by chunk
+			length, _ := strconv.ParseUint(c.GetHeader("Upload-Length"), 10, 64)
+			if !serv.admitContent(c, length) {
+				return
+			}
+		}
+
+		if maxDownloads, ok := metadata["max-downloads"]; ok {
+			if n, err := strconv.Atoi(maxDownloads); err != nil || n < 1 {
+				c.AbortWithStatusJSON(http.StatusBadRequest, "Invalid max-downloads")
+				return
+			}
+		}
+
+		if private, ok := metadata["private"]; ok {
+			isPrivate, err := strconv.ParseBool(private)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, "Invalid private")
+				return
+			}
+			if isPrivate && serv.cfg.SignedUrls.SigningKey == "" {
+				c.AbortWithStatusJSON(http.StatusBadRequest, "Private uploads are not enabled")
+				return
+			}
+		}
+
+		err := hashPassword(metadata)
+		if err != nil {
+			c.Error(err).SetType(gin.ErrorTypePublic)
+			c.AbortWithStatusJSON(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// only the hash of the deletion token is stored, the token itself is
+		// returned to the uploader once
+		deletionToken := shardedfilestore.Uid()
+		metadata["DeletionTokenHash"] = hashDeletionToken(deletionToken)
+		c.Request.Header.Set("Upload-Metadata", tusd.SerializeMetadataHeader(metadata))
+		c.Header(deletionTokenHeader, deletionToken)
+
 		handler.PostFile(c.Writer, c.Request)
 	}
 }
 
-func (serv *UploadServer) delFile(handler *tusd.UnroutedHandler) gin.HandlerFunc {
+// admitContent checks with the disk guard that length bytes of upload content
+// can be stored. It responds to the request and returns false if not.
+func (serv *UploadServer) admitContent(c *gin.Context, length uint64) bool {
+	if err := serv.diskGuard.Admit(length); err != nil {
+		c.Error(err).SetType(gin.ErrorTypePublic)
+		c.AbortWithStatusJSON(http.StatusInsufficientStorage, err.Error())
+		return false
+	}
+	return true
+}
+
+// guardPatch admits the content of uploads whose length was deferred, which
+// could not be checked when they were created. The declared length is
+// admitted less the content already received, and until it is declared each
+// chunk is admitted on its own.
+func (serv *UploadServer) guardPatch(next gin.HandlerFunc) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		id := c.Param("id")
-		metadata := c.MustGet("metadata").(map[string]string)
+		if serv.diskGuard == nil {
+			next(c)
+			return
+		}
+
+		deferred, err := serv.store.IsLengthDeferred(c.Param("id"))
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+			return
+		}
+		if deferred {
+			var length uint64
+			if c.Request.ContentLength > 0 {
+				length = uint64(c.Request.ContentLength)
+			}
+			if declared, err := strconv.ParseUint(c.GetHeader("Upload-Length"), 10, 64); err == nil {
+				offset, _ := strconv.ParseUint(c.GetHeader("Upload-Offset"), 10, 64)
+				length = 0
+				if declared > offset {
+					length = declared - offset
+				}
+			}
+			if !serv.admitContent(c, length) {
+				return
+			}
+		}
+
+		next(c)
+	}
+}
+
+// downloadAccess holds the restrictions placed on downloading an upload
+type downloadAccess struct {
+	Private      bool           `db:"private"`
+	PasswordHash sql.NullString `db:"password_hash"`
+	MaxDownloads int            `db:"max_downloads"`
+	Finished     bool           `db:"finished"`
+}
+
+// getDownloadAccess reads the restrictions of the requested upload. It
+// responds to the request and returns false on failure.
+func (serv *UploadServer) getDownloadAccess(c *gin.Context) (access downloadAccess, ok bool) {
+	err := serv.DBConn.DB.Get(&access, serv.DBConn.DB.Rebind(`
+		SELECT private, password_hash, max_downloads, (completed_at IS NOT NULL) AS finished
+		FROM uploads
+		WHERE id = ?
+	`), c.Param("id"))
+	if err != nil && err != sql.ErrNoRows {
+		// uploads unknown to the database are left for tusd to reject
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return access, false
+	}
+	return access, true
+}
+
+// authorizeDownload checks the signature of private uploads and the password
+// of protected ones. It responds to the request and returns false if either
+// is missing or wrong.
+func (serv *UploadServer) authorizeDownload(c *gin.Context, access downloadAccess) bool {
+	if access.Private && !serv.checkDownloadSignature(c) {
+		return false
+	}
+
+	if access.PasswordHash.String != "" && !serv.checkDownloadPassword(c, access.PasswordHash.String) {
+		return false
+	}
+
+	return true
+}
 
-		var uploaderIP, jwtAccount, jwtIssuer string
-		row := serv.DBConn.DB.QueryRow(`SELECT uploader_ip, jwt_account, jwt_issuer FROM uploads WHERE id = ?`, id)
-		err := row.Scan(&uploaderIP, &jwtAccount, &jwtIssuer)
+// headFile responds with the offset and metadata of an upload. Finished
+// uploads are protected like downloads, as the metadata names the file.
+// Unfinished uploads are left open so that their uploader can resume them.
+func (serv *UploadServer) headFile(handler *tusd.UnroutedHandler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		access, ok := serv.getDownloadAccess(c)
+		if !ok {
+			return
+		}
 
-		// no finalized upload exists
-		if err == sql.ErrNoRows {
-			c.AbortWithStatus(http.StatusNotFound)
+		if access.Finished && !serv.authorizeDownload(c, access) {
 			return
-		} else if err != nil {
-			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		}
+
+		handler.HeadFile(c.Writer, c.Request)
+	}
+}
+
+func (serv *UploadServer) getFile(handler *tusd.UnroutedHandler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		access, ok := serv.getDownloadAccess(c)
+		if !ok {
+			return
+		}
+
+		if !serv.authorizeDownload(c, access) {
+			return
+		}
+
+		id := c.Param("id")
+
+		// downloads of limited uploads are reserved before they start, so
+		// that concurrent requests can't get more than the limit
+		reserved := false
+		if access.MaxDownloads > 0 && access.Finished {
+			var err error
+			reserved, err = serv.store.ReserveDownload(id)
+			if err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+				return
+			}
+			if !reserved {
+				c.AbortWithStatus(http.StatusGone)
+				return
+			}
+		}
+
+		// the reservation is given back unless the download is counted,
+		// including when sending the file panics
+		counted := false
+		if reserved {
+			defer func() {
+				if !counted {
+					serv.releaseDownload(id)
+				}
+			}()
+		}
+
+		// the download has ended before it is counted, as the upload is only
+		// terminated at its limit once no download of it is running
+		func() {
+			serv.store.BeginDownload(id)
+			defer serv.store.EndDownload(id)
+			handler.GetFile(c.Writer, c.Request)
+		}()
+		if size := c.Writer.Size(); size > 0 {
+			metrics.BytesServed.Add(float64(size))
+		}
+
+		// only count downloads where the whole file was sent, and don't let
+		// link preview bots use up the download limit
+		complete := c.Writer.Status() == http.StatusOK &&
+			strconv.Itoa(c.Writer.Size()) == c.Writer.Header().Get("Content-Length")
+		if !complete || serv.isPreviewBot(c.Request.UserAgent()) {
 			return
 		}
 
-		if jwtAccount != "" && (jwtAccount != metadata["account"] || jwtIssuer != metadata["issuer"]) {
-			// The upload was created by an identified account that does not match this requests account
-			c.AbortWithStatus(http.StatusUnauthorized)
+		if !reserved {
+			serv.store.RecordDownload(id, int64(c.Writer.Size()))
 			return
-		} else if uploaderIP == "" || uploaderIP != metadata["RemoteIP"] {
-			// The upload was created by an anonymous user that does not match this requests ip address
-			c.AbortWithStatus(http.StatusUnauthorized)
+		}
+
+		counted = true
+		err := serv.store.CountDownload(id, int64(c.Writer.Size()))
+		if err != nil {
+			serv.log.Error().
+				Err(err).
+				Str("id", id).
+				Msg("Failed to count download")
+		}
+	}
+}
+
+// releaseDownload gives back the reservation of a download that doesn't count
+func (serv *UploadServer) releaseDownload(id string) {
+	err := serv.store.ReleaseDownload(id)
+	if err != nil {
+		serv.log.Error().
+			Err(err).
+			Str("id", id).
+			Msg("Failed to release download reservation")
+	}
+}
+
+func (serv *UploadServer) isPreviewBot(userAgent string) bool {
+	for _, pattern := range serv.cfg.Downloads.PreviewBotUserAgents {
+		if wildcard.Match(pattern, userAgent) {
+			return true
+		}
+	}
+	return false
+}
+
+func (serv *UploadServer) delFile(handler *tusd.UnroutedHandler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !serv.authorizeOwner(c) {
 			return
 		}
 
@@ -220,6 +481,63 @@ func (serv *UploadServer) delFile(handler *tusd.UnroutedHandler) gin.HandlerFunc
 	}
 }
 
+// authorizeOwner checks the request was made by the uploader of the upload, by
+// deletion token, or by account and ip address. It responds to the request and
+// returns false if not.
+func (serv *UploadServer) authorizeOwner(c *gin.Context) bool {
+	id := c.Param("id")
+	metadata := c.MustGet("metadata").(map[string]string)
+
+	var uploaderIP, jwtAccount, jwtIssuer string
+	var deletionTokenHash sql.NullString
+	row := serv.DBConn.DB.QueryRow(serv.DBConn.DB.Rebind(`SELECT uploader_ip, jwt_account, jwt_issuer, deletion_token_hash FROM uploads WHERE id = ?`), id)
+	err := row.Scan(&uploaderIP, &jwtAccount, &jwtIssuer, &deletionTokenHash)
+
+	// no finalized upload exists
+	if err == sql.ErrNoRows {
+		c.AbortWithStatus(http.StatusNotFound)
+		return false
+	} else if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return false
+	}
+
+	if checkDeletionToken(c.Request.Header.Get(deletionTokenHeader), deletionTokenHash) {
+		// The deletion token was presented, which grants access regardless of account or ip address
+	} else if jwtAccount != "" && (jwtAccount != metadata["account"] || jwtIssuer != metadata["issuer"]) {
+		// The upload was created by an identified account that does not match this requests account
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return false
+	} else if uploaderIP == "" || uploaderIP != metadata["RemoteIP"] {
+		// The upload was created from an ip address that does not match this requests ip address
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return false
+	} else if jwtAccount == "" && !serv.cfg.Server.AllowDeleteByIP {
+		// Anonymous uploads can only be authorized by their deletion token
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+// deletionTokenHeader is the header used to return and accept upload deletion tokens
+const deletionTokenHeader = "Upload-Deletion-Token"
+
+func hashDeletionToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// checkDeletionToken reports whether token matches the stored deletion token hash
+func checkDeletionToken(token string, storedHash sql.NullString) bool {
+	if token == "" || !storedHash.Valid {
+		return false
+	}
+	hash := hashDeletionToken(token)
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(storedHash.String)) == 1
+}
+
 func (serv *UploadServer) getSecretForToken(token *jwt.Token) (interface{}, error) {
 	// Don't forget to validate the alg is what you expect:
 	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
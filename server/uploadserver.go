@@ -2,15 +2,22 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"sync"
 
 	"github.com/gin-gonic/gin"
+	"github.com/kiwiirc/plugin-fileuploader/bans"
+	"github.com/kiwiirc/plugin-fileuploader/blocklist"
+	"github.com/kiwiirc/plugin-fileuploader/clamav"
 	"github.com/kiwiirc/plugin-fileuploader/config"
 	"github.com/kiwiirc/plugin-fileuploader/db"
+	"github.com/kiwiirc/plugin-fileuploader/diskguard"
 	"github.com/kiwiirc/plugin-fileuploader/events"
 	"github.com/kiwiirc/plugin-fileuploader/expirer"
+	"github.com/kiwiirc/plugin-fileuploader/icap"
 	"github.com/kiwiirc/plugin-fileuploader/logging"
+	"github.com/kiwiirc/plugin-fileuploader/metrics"
 	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
 	"github.com/rs/zerolog"
 )
@@ -22,13 +29,20 @@ type UploadServer struct {
 	Router *gin.Engine
 
 	cfg                 config.Config
+	runCtx              *RunContext
 	log                 *zerolog.Logger
 	store               *shardedfilestore.ShardedFileStore
 	expirer             *expirer.Expirer
+	diskGuard           *diskguard.Guard
 	httpServer          *http.Server
 	startedMu           sync.Mutex
 	started             chan struct{}
 	tusEventBroadcaster *events.TusEventBroadcaster
+	passwordLimiter     *rateLimiter
+	reportLimiter       *rateLimiter
+	bans                *bans.List
+	sweepStop           chan struct{} // closed to stop sweeping the blocklist
+	sweepDone           chan struct{} // closed once the blocklist sweep returned
 }
 
 // GetStartedChan returns a channel that will close when the server startup is complete
@@ -51,21 +65,80 @@ func init() {
 func (serv *UploadServer) Run(replaceableHandler *ReplaceableHandler) error {
 	serv.Router = gin.New()
 	serv.Router.Use(logging.GinLogger(serv.log), gin.Recovery())
+	if serv.cfg.Metrics.Enabled {
+		serv.Router.Use(metrics.GinMiddleware())
+	}
 
 	serv.DBConn = db.ConnectToDB(serv.log, db.DBConfig{
 		DriverName: serv.cfg.Database.Type,
 		DSN:        serv.cfg.Database.Path,
 	})
 
+	layout := shardedfilestore.Layout{Depth: serv.cfg.Storage.ShardLayers, Width: serv.cfg.Storage.ShardWidth}
+	if err := shardedfilestore.CheckLayout(serv.cfg.Storage.Path, layout); err != nil {
+		return err
+	}
+
 	serv.store = shardedfilestore.New(
 		serv.cfg.Storage.Path,
-		serv.cfg.Storage.ShardLayers,
+		layout,
 		serv.cfg.Expiration.MaxAge.Duration,
 		serv.cfg.Expiration.IdentifiedMaxAge.Duration,
+		serv.cfg.Expiration.TrashRetention.Duration,
+		serv.cfg.Expiration.SlidingStep.Duration,
+		serv.cfg.Expiration.SlidingMaxAge.Duration,
+		serv.cfg.Downloads.StatsFlushInterval.Duration,
 		serv.cfg.PreFinishCommands,
 		serv.DBConn,
 		serv.log,
 	)
+	serv.store.MetadataInDatabase = serv.cfg.Storage.MetadataInDatabase
+	metrics.SetStorageFunc(serv.store.StorageBytes)
+
+	if err := serv.store.CheckSchema(serv.cfg.Database.AutoMigrate); err != nil {
+		return err
+	}
+
+	if err := serv.loadBlocklist(); err != nil {
+		return err
+	}
+
+	if serv.cfg.ClamAV.Address != "" {
+		scanner, err := clamav.New(serv.cfg.ClamAV.Address, serv.cfg.ClamAV.Timeout.Duration)
+		if err != nil {
+			return err
+		}
+		serv.store.ClamAV = scanner
+		serv.store.ClamAVAction = serv.cfg.ClamAV.Action
+		serv.store.ClamAVFailOpen = serv.cfg.ClamAV.FailOpen
+		serv.store.ClamAVAcceptOversize = serv.cfg.ClamAV.AcceptOversize
+	}
+
+	if serv.cfg.ICAP.ServiceUrl != "" {
+		inspector, err := icap.New(
+			serv.cfg.ICAP.ServiceUrl,
+			serv.cfg.ICAP.Method,
+			serv.cfg.ICAP.Timeout.Duration,
+			serv.cfg.ICAP.PreviewSize,
+		)
+		if err != nil {
+			return err
+		}
+		serv.store.ICAP = inspector
+		serv.store.ICAPHeaders = serv.cfg.ICAP.Headers
+		serv.store.ICAPFailOpen = serv.cfg.ICAP.FailOpen
+	}
+
+	serv.passwordLimiter = newRateLimiter(
+		serv.cfg.Downloads.PasswordAttempts,
+		serv.cfg.Downloads.PasswordAttemptWindow.Duration,
+	)
+	serv.bans = bans.New(serv.DBConn, serv.cfg.Bans.RefreshInterval.Duration)
+
+	serv.reportLimiter = newRateLimiter(
+		serv.cfg.Reports.RateLimit,
+		serv.cfg.Reports.RateLimitWindow.Duration,
+	)
 
 	serv.expirer = expirer.New(
 		serv.store,
@@ -73,11 +146,37 @@ func (serv *UploadServer) Run(replaceableHandler *ReplaceableHandler) error {
 		serv.log,
 	)
 
+	guardCfg := serv.cfg.DiskGuard
+	limits := diskguard.Limits{
+		RejectBelowFree: uint64(guardCfg.RejectBelowFree),
+		EvictBelowFree:  uint64(guardCfg.EvictBelowFree),
+		MaxTotalSize:    uint64(guardCfg.MaxTotalSize),
+		EvictOrder:      guardCfg.EvictOrder,
+	}
+	if limits.Enabled() && guardCfg.CheckInterval.Duration > 0 {
+		serv.diskGuard = diskguard.New(serv.store, limits, guardCfg.CheckInterval.Duration, serv.log)
+	}
+
 	err := serv.registerTusHandlers(serv.Router, serv.store)
 	if err != nil {
 		return err
 	}
 
+	err = serv.registerAdminHandlers(serv.Router)
+	if err != nil {
+		return err
+	}
+
+	err = serv.registerMetricsHandler(serv.Router)
+	if err != nil {
+		return err
+	}
+
+	err = serv.registerHealthHandlers(serv.Router)
+	if err != nil {
+		return err
+	}
+
 	// closed channel indicates that startup is complete
 	close(serv.GetStartedChan())
 
@@ -96,6 +195,56 @@ func (serv *UploadServer) Run(replaceableHandler *ReplaceableHandler) error {
 	return serv.httpServer.ListenAndServe()
 }
 
+// loadBlocklist loads the configured blocklist into the store, and terminates
+// existing uploads that match it in the background. The server refuses to
+// start with a blocklist that could not be loaded completely.
+func (serv *UploadServer) loadBlocklist() error {
+	var dbConn *db.DatabaseConnection
+	if serv.cfg.Blocklist.UseDatabase {
+		dbConn = serv.DBConn
+	}
+
+	blocked, err := blocklist.Load(serv.cfg.Blocklist.Files, dbConn)
+	if err != nil {
+		return fmt.Errorf("failed to load blocklist: %w", err)
+	}
+
+	serv.store.Blocklist = blocked
+	serv.store.BlocklistStatus = serv.cfg.Blocklist.RejectStatus
+
+	if blocked.Len() > 0 {
+		serv.log.Info().
+			Str("event", "blocklist_loaded").
+			Int("count", blocked.Len()).
+			Msg("Loaded blocklist")
+
+		serv.sweepStop = make(chan struct{})
+		serv.sweepDone = make(chan struct{})
+		go func() {
+			defer close(serv.sweepDone)
+			serv.store.SweepBlocklist(serv.sweepStop)
+		}()
+	}
+
+	perceptual, err := blocklist.LoadPerceptual(serv.cfg.Blocklist.PerceptualFiles, dbConn)
+	if err != nil {
+		return fmt.Errorf("failed to load perceptual blocklist: %w", err)
+	}
+
+	serv.store.HashImages = serv.cfg.Blocklist.HashImages
+	serv.store.PerceptualBlocklist = perceptual
+	serv.store.PerceptualThreshold = serv.cfg.Blocklist.PerceptualThreshold
+	serv.store.PerceptualAction = serv.cfg.Blocklist.PerceptualAction
+
+	if perceptual.Len() > 0 {
+		serv.log.Info().
+			Str("event", "perceptual_blocklist_loaded").
+			Int("count", perceptual.Len()).
+			Msg("Loaded perceptual blocklist")
+	}
+	return nil
+}
+
 // Shutdown gracefully terminates the UploadServer instance.
 // The HTTP listen socket will close immediately, causing the .Run() call to return.
 // The call to .Shutdown() will block until all outstanding requests have been served and
@@ -111,6 +260,23 @@ func (serv *UploadServer) Shutdown() {
 
 	// stop running FileStore GC cycles
 	serv.expirer.Stop()
+	if serv.diskGuard != nil {
+		serv.diskGuard.Stop()
+	}
+
+	// stop sweeping the blocklist before the database is closed
+	if serv.sweepStop != nil {
+		close(serv.sweepStop)
+		<-serv.sweepDone
+	}
+
+	// write buffered download statistics
+	err := serv.store.Close()
+	if err != nil {
+		serv.log.Error().
+			Err(err).
+			Msg("Failed to flush download statistics")
+	}
 
 	// close db connections
 	serv.DBConn.DB.Close()
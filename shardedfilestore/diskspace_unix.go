@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package shardedfilestore
+
+import "syscall"
+
+func diskSpace(path string) (*DiskSpace, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return nil, err
+	}
+	return &DiskSpace{
+		Free:  uint64(stat.Bavail) * uint64(stat.Bsize),
+		Total: uint64(stat.Blocks) * uint64(stat.Bsize),
+	}, nil
+}
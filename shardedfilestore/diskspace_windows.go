@@ -0,0 +1,5 @@
+package shardedfilestore
+
+func diskSpace(path string) (*DiskSpace, error) {
+	return nil, ErrDiskSpaceUnsupported
+}
@@ -0,0 +1,218 @@
+package shardedfilestore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// downloadStats buffers download statistics in memory so that busy uploads
+// don't need a database write for every download
+type downloadStats struct {
+	mu       sync.Mutex
+	pending  map[string]*pendingDownloads
+	active   map[string]int // number of downloads in progress per upload
+	quitChan chan struct{}  // closes to stop the flush loop
+	doneChan chan struct{}  // closes when the flush loop has exited
+}
+
+type pendingDownloads struct {
+	count        int64
+	bytes        int64
+	lastAccessed int64
+}
+
+func newDownloadStats() *downloadStats {
+	return &downloadStats{
+		pending:  make(map[string]*pendingDownloads),
+		active:   make(map[string]int),
+		quitChan: make(chan struct{}),
+		doneChan: make(chan struct{}),
+	}
+}
+
+// add merges downloads into the pending statistics of an upload
+func (stats *downloadStats) add(id string, downloads pendingDownloads) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	pending, ok := stats.pending[id]
+	if !ok {
+		pending = &pendingDownloads{}
+		stats.pending[id] = pending
+	}
+	pending.count += downloads.count
+	pending.bytes += downloads.bytes
+	if downloads.lastAccessed > pending.lastAccessed {
+		pending.lastAccessed = downloads.lastAccessed
+	}
+}
+
+// get returns the not yet flushed statistics of an upload
+func (stats *downloadStats) get(id string) pendingDownloads {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	if pending, ok := stats.pending[id]; ok {
+		return *pending
+	}
+	return pendingDownloads{}
+}
+
+// take removes and returns all pending statistics
+func (stats *downloadStats) take() map[string]*pendingDownloads {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	pending := stats.pending
+	stats.pending = make(map[string]*pendingDownloads)
+	return pending
+}
+
+// BeginDownload marks an upload as being downloaded until EndDownload is called,
+// which stops the expirer from terminating it mid-stream
+func (store *ShardedFileStore) BeginDownload(id string) {
+	store.downloadStats.mu.Lock()
+	defer store.downloadStats.mu.Unlock()
+
+	store.downloadStats.active[id]++
+}
+
+// EndDownload marks a download started with BeginDownload as finished
+func (store *ShardedFileStore) EndDownload(id string) {
+	store.downloadStats.mu.Lock()
+	defer store.downloadStats.mu.Unlock()
+
+	store.downloadStats.active[id]--
+	if store.downloadStats.active[id] <= 0 {
+		delete(store.downloadStats.active, id)
+	}
+}
+
+// IsDownloading reports whether an upload is currently being downloaded
+func (store *ShardedFileStore) IsDownloading(id string) bool {
+	store.downloadStats.mu.Lock()
+	defer store.downloadStats.mu.Unlock()
+
+	return store.downloadStats.active[id] > 0
+}
+
+// RecordDownload buffers a completed download of an upload. The statistics
+// are written to the database by FlushDownloadStats.
+func (store *ShardedFileStore) RecordDownload(id string, bytes int64) {
+	store.downloadStats.add(id, pendingDownloads{
+		count:        1,
+		bytes:        bytes,
+		lastAccessed: time.Now().Unix(),
+	})
+
+	store.log.Info().
+		Str("event", "downloaded").
+		Str("id", id).
+		Int64("bytes", bytes).
+		Msg("Upload downloaded")
+}
+
+// FlushDownloadStats writes the buffered download statistics to the database
+// in a single transaction, extending the expiry of identified uploads when
+// sliding expiry is enabled
+func (store *ShardedFileStore) FlushDownloadStats() error {
+	pending := store.downloadStats.take()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	err := store.writeDownloadStats(pending)
+	if err != nil {
+		// keep the statistics for the next attempt
+		for id, downloads := range pending {
+			store.downloadStats.add(id, *downloads)
+		}
+		return err
+	}
+
+	store.log.Debug().
+		Str("event", "download_stats_flushed").
+		Int("uploads", len(pending)).
+		Msg("Flushed download statistics")
+
+	return nil
+}
+
+func (store *ShardedFileStore) writeDownloadStats(pending map[string]*pendingDownloads) error {
+	tx, err := store.DBConn.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for id, downloads := range pending {
+		_, err := tx.Exec(tx.Rebind(`
+			UPDATE uploads
+			SET download_count = download_count + ?,
+			bytes_served = bytes_served + ?,
+			last_accessed_at = ?
+			WHERE id = ?
+		`), downloads.count, downloads.bytes, downloads.lastAccessed, id)
+		if err != nil {
+			return err
+		}
+
+		if store.SlidingStep > 0 {
+			err = store.slideExpiry(tx, id, downloads.lastAccessed)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// slideExpiry pushes the expiry of an identified upload to at least SlidingStep
+// after the last access, capped at SlidingMaxAge after its creation
+func (store *ShardedFileStore) slideExpiry(tx *sqlx.Tx, id string, lastAccessed int64) error {
+	target := lastAccessed + int64(store.SlidingStep.Seconds())
+	maxAge := int64(store.SlidingMaxAge.Seconds())
+
+	_, err := tx.Exec(tx.Rebind(`
+		UPDATE uploads
+		SET expires_at = CASE WHEN created_at + ? < ? THEN created_at + ? ELSE ? END
+		WHERE id = ? AND
+			jwt_account != '' AND
+			deleted = 0 AND
+			expires_at < ? AND
+			expires_at < created_at + ?
+	`), maxAge, target, maxAge, target, id, target, maxAge)
+	return err
+}
+
+func (store *ShardedFileStore) flushLoop(interval time.Duration) {
+	defer close(store.downloadStats.doneChan)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := store.FlushDownloadStats()
+			if err != nil {
+				store.log.Error().
+					Err(err).
+					Msg("Failed to flush download statistics")
+			}
+		case <-store.downloadStats.quitChan:
+			return
+		}
+	}
+}
+
+// Close stops the background flushing of download statistics and writes any
+// that are still buffered
+func (store *ShardedFileStore) Close() error {
+	close(store.downloadStats.quitChan)
+	<-store.downloadStats.doneChan
+	return store.FlushDownloadStats()
+}
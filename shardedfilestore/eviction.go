@@ -0,0 +1,63 @@
+package shardedfilestore
+
+import (
+	"database/sql"
+)
+
+// AllocatedBytes sums the declared size of every upload that may have files
+// in storage, including the unfinished ones, which will grow to that size
+func (store *ShardedFileStore) AllocatedBytes() (total int64, err error) {
+	err = store.DBConn.DB.QueryRow(`
+		SELECT COALESCE(SUM(size), 0)
+		FROM uploads
+		WHERE purged = 0
+	`).Scan(&total)
+	return
+}
+
+// IsLengthDeferred returns whether an upload has not declared its length yet
+func (store *ShardedFileStore) IsLengthDeferred(id string) (bool, error) {
+	var size sql.NullInt64
+	err := store.DBConn.DB.Get(&size, store.DBConn.DB.Rebind(`SELECT size FROM uploads WHERE id = ?`), id)
+	if err == sql.ErrNoRows {
+		// unknown uploads are left for tusd to reject
+		return false, nil
+	}
+	return err == nil && !size.Valid, err
+}
+
+// EvictionCandidate is an upload that may be removed to free disk space
+type EvictionCandidate struct {
+	ID        string `db:"id"`
+	Size      int64  `db:"size"`
+	CreatedAt int64  `db:"created_at"`
+	Deleted   bool   `db:"deleted"`
+}
+
+// ListTrashed returns the unpurged uploads in the trash, longest deleted
+// first
+func (store *ShardedFileStore) ListTrashed() (candidates []EvictionCandidate, err error) {
+	err = store.DBConn.DB.Select(&candidates, `
+		SELECT id, COALESCE(size, 0) AS size, created_at, deleted
+		FROM uploads
+		WHERE deleted = 1 AND purged = 0
+		ORDER BY deleted_at
+	`)
+	return
+}
+
+// ListEvictable returns the finished anonymous uploads, oldest or largest
+// first. Quarantined uploads are kept for moderators.
+func (store *ShardedFileStore) ListEvictable(largestFirst bool) (candidates []EvictionCandidate, err error) {
+	order := "created_at"
+	if largestFirst {
+		order = "size DESC, created_at"
+	}
+	err = store.DBConn.DB.Select(&candidates, `
+		SELECT id, COALESCE(size, 0) AS size, created_at, deleted
+		FROM uploads
+		WHERE deleted = 0 AND quarantined = 0
+			AND sha256sum IS NOT NULL AND jwt_account = ''
+		ORDER BY `+order)
+	return
+}
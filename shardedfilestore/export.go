@@ -0,0 +1,458 @@
+package shardedfilestore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	migrate "github.com/rubenv/sql-migrate"
+
+	"github.com/kiwiirc/plugin-fileuploader/db"
+)
+
+// exportVersion is the version of the export format
+const exportVersion = 1
+
+// ErrNotEmpty is returned when importing into a database that already has data
+var ErrNotEmpty = errors.New("target database is not empty")
+
+// TableSummary identifies the content of a table, to check that a copy is complete
+type TableSummary struct {
+	Rows   int    `json:"rows"`
+	SHA256 string `json:"sha256"` // Hash of the sorted hashes of every row
+}
+
+// exportLine is a line of an export file. The header comes first, followed by
+// a row line for each row of each table, and the footer last.
+type exportLine struct {
+	Type       string                  `json:"type"` // "header", "row" or "footer"
+	Version    int                     `json:"version,omitempty"`
+	Migrations []string                `json:"migrations,omitempty"`
+	Table      string                  `json:"table,omitempty"`
+	Row        json.RawMessage         `json:"row,omitempty"`
+	Tables     map[string]TableSummary `json:"tables,omitempty"`
+}
+
+type exportedUpload struct {
+	ID                string  `db:"id" json:"id"`
+	UploaderIP        *string `db:"uploader_ip" json:"uploader_ip"`
+	SHA256Sum         []byte  `db:"sha256sum" json:"sha256sum"`
+	CreatedAt         *int64  `db:"created_at" json:"created_at"`
+	ExpiresAt         *int64  `db:"expires_at" json:"expires_at"`
+	Deleted           db.Bool `db:"deleted" json:"deleted"`
+	JwtAccount        string  `db:"jwt_account" json:"jwt_account"`
+	JwtIssuer         string  `db:"jwt_issuer" json:"jwt_issuer"`
+	DeletedAt         *int64  `db:"deleted_at" json:"deleted_at"`
+	Purged            db.Bool `db:"purged" json:"purged"`
+	DeletionTokenHash *string `db:"deletion_token_hash" json:"deletion_token_hash"`
+	MaxDownloads      int64   `db:"max_downloads" json:"max_downloads"`
+	DownloadCount     int64   `db:"download_count" json:"download_count"`
+	PasswordHash      *string `db:"password_hash" json:"password_hash"`
+	Private           db.Bool `db:"private" json:"private"`
+	BytesServed       int64   `db:"bytes_served" json:"bytes_served"`
+	LastAccessedAt    *int64  `db:"last_accessed_at" json:"last_accessed_at"`
+	PHash             *string `db:"phash" json:"phash"`
+	Quarantined       db.Bool `db:"quarantined" json:"quarantined"`
+	Filename          *string `db:"filename" json:"filename"`
+	Filetype          *string `db:"filetype" json:"filetype"`
+	Size              *int64  `db:"size" json:"size"`
+	CompletedAt       *int64  `db:"completed_at" json:"completed_at"`
+	ReportCount       int64   `db:"report_count" json:"report_count"`
+	Released          db.Bool `db:"quarantine_released" json:"quarantine_released"`
+}
+
+type exportedUploadInfo struct {
+	ID   string `db:"id" json:"id"`
+	Info string `db:"info" json:"info"`
+}
+
+type exportedBlocklistEntry struct {
+	SHA256Sum string `db:"sha256sum" json:"sha256sum"`
+	Reason    string `db:"reason" json:"reason"`
+	CreatedAt *int64 `db:"created_at" json:"created_at"`
+}
+
+type exportedPerceptualBlocklistEntry struct {
+	PHash     string `db:"phash" json:"phash"`
+	Reason    string `db:"reason" json:"reason"`
+	CreatedAt *int64 `db:"created_at" json:"created_at"`
+}
+
+type exportedReport struct {
+	ID              string  `db:"id" json:"id"`
+	UploadID        string  `db:"upload_id" json:"upload_id"`
+	ReporterIP      *string `db:"reporter_ip" json:"reporter_ip"`
+	ReporterAccount string  `db:"reporter_account" json:"reporter_account"`
+	ReporterIssuer  string  `db:"reporter_issuer" json:"reporter_issuer"`
+	Reason          string  `db:"reason" json:"reason"`
+	CreatedAt       *int64  `db:"created_at" json:"created_at"`
+}
+
+type exportedBan struct {
+	ID         string `db:"id" json:"id"`
+	IPRange    string `db:"ip_range" json:"ip_range"`
+	JwtAccount string `db:"jwt_account" json:"jwt_account"`
+	JwtIssuer  string `db:"jwt_issuer" json:"jwt_issuer"`
+	Reason     string `db:"reason" json:"reason"`
+	CreatedBy  string `db:"created_by" json:"created_by"`
+	CreatedAt  *int64 `db:"created_at" json:"created_at"`
+	ExpiresAt  *int64 `db:"expires_at" json:"expires_at"`
+}
+
+// exportTable is a table copied by exports, imports and copies
+type exportTable struct {
+	name   string
+	newRow func() interface{}
+}
+
+// exportTables are the tables holding data, in the order they are copied
+var exportTables = []exportTable{
+	{"uploads", func() interface{} { return new(exportedUpload) }},
+	{"upload_info", func() interface{} { return new(exportedUploadInfo) }},
+	{"blocklist", func() interface{} { return new(exportedBlocklistEntry) }},
+	{"phash_blocklist", func() interface{} { return new(exportedPerceptualBlocklistEntry) }},
+	{"reports", func() interface{} { return new(exportedReport) }},
+	{"bans", func() interface{} { return new(exportedBan) }},
+}
+
+// ExportTableNames returns the names of the tables copied by exports, imports
+// and copies, in the order they are copied
+func ExportTableNames() []string {
+	names := make([]string, len(exportTables))
+	for i, table := range exportTables {
+		names[i] = table.name
+	}
+	return names
+}
+
+// columns returns the columns of the table, from the db tags of its rows
+func (table exportTable) columns() []string {
+	rowType := reflect.TypeOf(table.newRow()).Elem()
+	columns := make([]string, rowType.NumField())
+	for i := range columns {
+		columns[i] = rowType.Field(i).Tag.Get("db")
+	}
+	return columns
+}
+
+func (table exportTable) selectQuery() string {
+	return "SELECT " + strings.Join(table.columns(), ", ") + " FROM " + table.name
+}
+
+func (table exportTable) insertQuery() string {
+	columns := table.columns()
+	return "INSERT INTO " + table.name + " (" + strings.Join(columns, ", ") + ") VALUES (:" + strings.Join(columns, ", :") + ")"
+}
+
+func findExportTable(name string) (exportTable, bool) {
+	for _, table := range exportTables {
+		if table.name == name {
+			return table, true
+		}
+	}
+	return exportTable{}, false
+}
+
+// tableHasher computes the summary of a table from its rows, whatever their order
+type tableHasher struct {
+	rowHashes [][]byte
+}
+
+func (hasher *tableHasher) add(row []byte) {
+	hash := sha256.Sum256(row)
+	hasher.rowHashes = append(hasher.rowHashes, hash[:])
+}
+
+func (hasher *tableHasher) summary() TableSummary {
+	sort.Slice(hasher.rowHashes, func(i, j int) bool {
+		return bytes.Compare(hasher.rowHashes[i], hasher.rowHashes[j]) < 0
+	})
+	hash := sha256.New()
+	for _, rowHash := range hasher.rowHashes {
+		hash.Write(rowHash)
+	}
+	return TableSummary{
+		Rows:   len(hasher.rowHashes),
+		SHA256: hex.EncodeToString(hash.Sum(nil)),
+	}
+}
+
+// eachRow calls fn with every row of a table, encoded as JSON
+func eachRow(q sqlx.Queryer, table exportTable, fn func(row []byte) error) error {
+	rows, err := q.Queryx(table.selectQuery())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		row := table.newRow()
+		if err := rows.StructScan(row); err != nil {
+			return err
+		}
+		data, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		if err := fn(data); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// summarize computes the summary of every table
+func summarize(q sqlx.Queryer) (map[string]TableSummary, error) {
+	summaries := make(map[string]TableSummary)
+	for _, table := range exportTables {
+		var hasher tableHasher
+		err := eachRow(q, table, func(row []byte) error {
+			hasher.add(row)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		summaries[table.name] = hasher.summary()
+	}
+	return summaries, nil
+}
+
+// compareSummaries returns an error describing the first table that differs
+func compareSummaries(expected, actual map[string]TableSummary) error {
+	for _, table := range exportTables {
+		if expected[table.name] != actual[table.name] {
+			return fmt.Errorf(
+				"table %s differs from the source: expected %d rows with hash %s, got %d rows with hash %s",
+				table.name,
+				expected[table.name].Rows, expected[table.name].SHA256,
+				actual[table.name].Rows, actual[table.name].SHA256,
+			)
+		}
+	}
+	return nil
+}
+
+// Export writes the applied migrations and every row of the database to w as
+// JSON lines, which can be read by Import into any supported database
+func (store *ShardedFileStore) Export(w io.Writer) (map[string]TableSummary, error) {
+	records, err := migrate.GetMigrationRecords(store.DBConn.DB.DB, store.DBConn.DriverName)
+	if err != nil {
+		return nil, err
+	}
+	migrations := make([]string, len(records))
+	for i, record := range records {
+		migrations[i] = record.Id
+	}
+
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	err = encoder.Encode(exportLine{Type: "header", Version: exportVersion, Migrations: migrations})
+	if err != nil {
+		return nil, err
+	}
+
+	// read every table in one transaction, so the export is consistent
+	tx, err := store.DBConn.DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	summaries := make(map[string]TableSummary)
+	for _, table := range exportTables {
+		var hasher tableHasher
+		err := eachRow(tx, table, func(row []byte) error {
+			hasher.add(row)
+			return encoder.Encode(exportLine{Type: "row", Table: table.name, Row: row})
+		})
+		if err != nil {
+			return nil, err
+		}
+		summaries[table.name] = hasher.summary()
+	}
+
+	err = encoder.Encode(exportLine{Type: "footer", Tables: summaries})
+	if err != nil {
+		return nil, err
+	}
+	return summaries, buffered.Flush()
+}
+
+// Import reads an export written by Export into the store's database, which
+// must be empty. Nothing is imported unless every table matches the summary
+// at the end of the export.
+func (store *ShardedFileStore) Import(r io.Reader) (map[string]TableSummary, error) {
+	if err := checkEmpty(store.DBConn); err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var header exportLine
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("export is empty")
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Type != "header" {
+		return nil, errors.New("export does not start with a header")
+	}
+	if header.Version != exportVersion {
+		return nil, fmt.Errorf("unsupported export version %d", header.Version)
+	}
+	if err := store.checkMigrations(header.Migrations); err != nil {
+		return nil, err
+	}
+
+	tx, err := store.DBConn.DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var footer *exportLine
+	lineNumber := 1
+	for scanner.Scan() {
+		lineNumber++
+		if footer != nil {
+			return nil, fmt.Errorf("line %d: unexpected data after the footer", lineNumber)
+		}
+
+		var line exportLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+
+		switch line.Type {
+		case "row":
+			table, ok := findExportTable(line.Table)
+			if !ok {
+				return nil, fmt.Errorf("line %d: unknown table %#v", lineNumber, line.Table)
+			}
+			row := table.newRow()
+			if err := json.Unmarshal(line.Row, row); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			if _, err := tx.NamedExec(table.insertQuery(), row); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+		case "footer":
+			footer = &line
+		default:
+			return nil, fmt.Errorf("line %d: unexpected %#v line", lineNumber, line.Type)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if footer == nil {
+		return nil, errors.New("export is incomplete, the footer is missing")
+	}
+
+	summaries, err := summarize(tx)
+	if err != nil {
+		return nil, err
+	}
+	if err := compareSummaries(footer.Tables, summaries); err != nil {
+		return nil, err
+	}
+
+	return summaries, tx.Commit()
+}
+
+// CopyTo copies every row of the store's database to another database, which
+// is migrated first and must be empty. Nothing is copied unless the row
+// counts and hashes of every table match.
+func (store *ShardedFileStore) CopyTo(target *db.DatabaseConnection) (map[string]TableSummary, error) {
+	if _, err := store.migrateDB(target, migrate.Up, 0); err != nil {
+		return nil, err
+	}
+	if err := checkEmpty(target); err != nil {
+		return nil, err
+	}
+
+	source, err := store.DBConn.DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer source.Rollback()
+
+	tx, err := target.DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	expected := make(map[string]TableSummary)
+	for _, table := range exportTables {
+		var hasher tableHasher
+		query := table.insertQuery()
+		err := eachRow(source, table, func(data []byte) error {
+			hasher.add(data)
+
+			// insert the row as decoded from JSON, so that it matches the hash
+			row := table.newRow()
+			if err := json.Unmarshal(data, row); err != nil {
+				return err
+			}
+			_, err := tx.NamedExec(query, row)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("copying %s: %w", table.name, err)
+		}
+		expected[table.name] = hasher.summary()
+	}
+
+	summaries, err := summarize(tx)
+	if err != nil {
+		return nil, err
+	}
+	if err := compareSummaries(expected, summaries); err != nil {
+		return nil, err
+	}
+
+	return summaries, tx.Commit()
+}
+
+// checkMigrations makes sure that the data of an export with the given
+// migrations fits the current schema
+func (store *ShardedFileStore) checkMigrations(ids []string) error {
+	known := make(map[string]bool)
+	for _, migration := range store.migrations().Migrations {
+		known[migration.Id] = true
+	}
+	for _, id := range ids {
+		if !known[id] {
+			return fmt.Errorf("export was made with a newer version, which applied unknown migration %s", id)
+		}
+	}
+	return nil
+}
+
+// checkEmpty returns ErrNotEmpty when any table of a database has rows
+func checkEmpty(conn *db.DatabaseConnection) error {
+	for _, table := range exportTables {
+		var count int
+		err := conn.DB.Get(&count, "SELECT COUNT(*) FROM "+table.name)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("%w: table %s has %d rows", ErrNotEmpty, table.name, count)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,419 @@
+package shardedfilestore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Kinds of inconsistencies found by Fsck
+const (
+	FsckMissingBlob = "missing_blob" // a finished upload's blob is not on disk
+	FsckOrphanBlob  = "orphan_blob"  // a blob that no upload refers to
+	FsckOrphanInfo  = "orphan_info"  // an .info file without a live upload
+	FsckDeletedBlob = "deleted_blob" // a blob of purged uploads that is still on disk
+	FsckCorruptBlob = "corrupt_blob" // a blob whose content doesn't match its hash
+)
+
+var errHashMismatch = errors.New("content does not match its hash")
+
+// FsckOptions controls what Fsck checks and whether it repairs what it finds
+type FsckOptions struct {
+	Repair       bool // Fix the problems found
+	VerifyHashes bool // Hash the content of every blob, which reads the whole store
+}
+
+// FsckProblem is an inconsistency between the database and the files in storage
+type FsckProblem struct {
+	Kind   string `json:"kind"`
+	ID     string `json:"id,omitempty"` // Upload concerned, if any
+	Path   string `json:"path,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Repair string `json:"repair,omitempty"` // What was done to fix the problem
+	Error  string `json:"error,omitempty"`  // Why the repair failed
+}
+
+// FsckReport lists the problems found by Fsck
+type FsckReport struct {
+	Rows     int           `json:"rows"`
+	Blobs    int           `json:"blobs"`
+	Infos    int           `json:"infos"`
+	Problems []FsckProblem `json:"problems"`
+}
+
+// Unrepaired counts the problems that are still present
+func (report *FsckReport) Unrepaired() int {
+	count := 0
+	for _, problem := range report.Problems {
+		if problem.Repair == "" {
+			count++
+		}
+	}
+	return count
+}
+
+type fsckRow struct {
+	ID        string `db:"id"`
+	SHA256Sum []byte `db:"sha256sum"`
+	Deleted   bool   `db:"deleted"`
+	Purged    bool   `db:"purged"`
+}
+
+// fsck holds the state of a single Fsck run
+type fsck struct {
+	store   *ShardedFileStore
+	options FsckOptions
+	report  *FsckReport
+
+	rows map[string]*fsckRow
+	// rows of each hash, by hex encoded hash
+	rowsByHash map[string][]*fsckRow
+	// finished uploads whose blob was left under incomplete/
+	stranded map[string]bool
+}
+
+// Fsck compares the uploads table with the blobs under complete/ and
+// incomplete/ and the .info files under meta/, and repairs what it can when
+// asked to. It should run while no uploads are in progress, as their files are
+// created and moved after their rows are updated.
+func (store *ShardedFileStore) Fsck(options FsckOptions) (*FsckReport, error) {
+	check := &fsck{
+		store:      store,
+		options:    options,
+		report:     &FsckReport{Problems: make([]FsckProblem, 0)},
+		rows:       make(map[string]*fsckRow),
+		rowsByHash: make(map[string][]*fsckRow),
+		stranded:   make(map[string]bool),
+	}
+
+	var rows []*fsckRow
+	err := store.DBConn.DB.Select(&rows, `SELECT id, sha256sum, deleted, purged FROM uploads`)
+	if err != nil {
+		return nil, err
+	}
+	check.report.Rows = len(rows)
+	for _, row := range rows {
+		check.rows[row.ID] = row
+		if row.SHA256Sum != nil {
+			hash := hex.EncodeToString(row.SHA256Sum)
+			check.rowsByHash[hash] = append(check.rowsByHash[hash], row)
+		}
+	}
+
+	if err := check.missingBlobs(); err != nil {
+		return nil, err
+	}
+	if err := check.completeBlobs(); err != nil {
+		return nil, err
+	}
+	if err := check.incompleteBlobs(); err != nil {
+		return nil, err
+	}
+	if err := check.infoFiles(); err != nil {
+		return nil, err
+	}
+
+	return check.report, nil
+}
+
+// missingBlobs finds the finished uploads whose blob is not on disk. When the
+// move out of incomplete/ failed, the blob is recovered from there, otherwise
+// the uploads are purged.
+func (check *fsck) missingBlobs() error {
+	for hash, rows := range check.rowsByHash {
+		live := liveRows(rows)
+		if len(live) == 0 {
+			continue
+		}
+
+		path := check.store.completeBinPath(live[0].SHA256Sum)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		// look for a copy left behind by any of the uploads sharing the blob
+		var recoverable string
+		for _, row := range live {
+			incompletePath := check.store.incompleteBinPath(row.ID)
+			if _, err := os.Stat(incompletePath); err != nil {
+				continue
+			}
+			check.stranded[row.ID] = true
+			if recoverable == "" {
+				recoverable = incompletePath
+			}
+		}
+
+		if !check.options.Repair {
+			for _, row := range live {
+				check.add(FsckProblem{Kind: FsckMissingBlob, ID: row.ID, Path: path, SHA256: hash}, nil)
+			}
+			continue
+		}
+
+		if recoverable != "" {
+			err := check.recoverBlob(recoverable, path, live[0].SHA256Sum)
+			if err == nil {
+				for _, row := range live {
+					check.add(FsckProblem{
+						Kind:   FsckMissingBlob,
+						ID:     row.ID,
+						Path:   path,
+						SHA256: hash,
+						Repair: "recovered from " + recoverable,
+					}, nil)
+				}
+				continue
+			}
+			check.store.log.Warn().
+				Err(err).
+				Str("event", "fsck_recover_failed").
+				Str("path", recoverable).
+				Msg("Could not recover blob from incomplete uploads")
+		}
+
+		for _, row := range live {
+			problem := FsckProblem{Kind: FsckMissingBlob, ID: row.ID, Path: path, SHA256: hash}
+			check.purge(problem, row)
+		}
+	}
+	return nil
+}
+
+// recoverBlob moves a blob left under incomplete/ to where it belongs, after
+// checking that its content is the one expected
+func (check *fsck) recoverBlob(from, to string, hash []byte) error {
+	actual, err := hashPath(from)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(actual, hash) {
+		return errHashMismatch
+	}
+	if err := os.MkdirAll(filepath.Dir(to), defaultDirectoryPerm); err != nil {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+// completeBlobs finds the blobs under complete/ that are not referred to by
+// any upload, that only belong to purged uploads, or whose content doesn't
+// match their hash
+func (check *fsck) completeBlobs() error {
+	return walkFiles(filepath.Join(check.store.BasePath, "complete"), ".bin", func(path string) error {
+		check.report.Blobs++
+		hash := strings.TrimSuffix(filepath.Base(path), ".bin")
+
+		rows := check.rowsByHash[hash]
+		if len(rows) == 0 {
+			check.remove(FsckProblem{Kind: FsckOrphanBlob, Path: path, SHA256: hash})
+			return nil
+		}
+
+		live := liveRows(rows)
+		if len(live) == 0 {
+			check.remove(FsckProblem{Kind: FsckDeletedBlob, ID: rows[0].ID, Path: path, SHA256: hash})
+			return nil
+		}
+
+		if !check.options.VerifyHashes {
+			return nil
+		}
+		actual, err := hashPath(path)
+		if err != nil {
+			return err
+		}
+		if hex.EncodeToString(actual) == hash {
+			return nil
+		}
+
+		// the content can't be recovered, so keep the blob aside for
+		// inspection and purge the uploads that would serve it
+		if !check.options.Repair {
+			for _, row := range live {
+				check.add(FsckProblem{Kind: FsckCorruptBlob, ID: row.ID, Path: path, SHA256: hash}, nil)
+			}
+			return nil
+		}
+
+		corruptPath := filepath.Join(check.store.BasePath, "corrupt", hash+".bin")
+		err = os.MkdirAll(filepath.Dir(corruptPath), defaultDirectoryPerm)
+		if err == nil {
+			err = os.Rename(path, corruptPath)
+		}
+		for _, row := range live {
+			problem := FsckProblem{Kind: FsckCorruptBlob, ID: row.ID, Path: path, SHA256: hash}
+			if err != nil {
+				check.add(problem, err)
+				continue
+			}
+			check.purge(problem, row)
+		}
+		return nil
+	})
+}
+
+// incompleteBlobs finds the blobs under incomplete/ that no unfinished upload
+// refers to
+func (check *fsck) incompleteBlobs() error {
+	return walkFiles(check.store.incompleteBinDir(), ".bin", func(path string) error {
+		check.report.Blobs++
+		id := strings.TrimSuffix(filepath.Base(path), ".bin")
+
+		row := check.rows[id]
+		switch {
+		case row == nil, row.Purged:
+		case row.SHA256Sum == nil:
+			// still being uploaded, or in the trash
+			return nil
+		case check.stranded[id] && !check.options.Repair:
+			// reported as recoverable by missingBlobs
+			return nil
+		}
+
+		check.remove(FsckProblem{Kind: FsckOrphanBlob, ID: id, Path: path})
+		return nil
+	})
+}
+
+// infoFiles finds the .info files under meta/, or the rows of the upload_info
+// table, that belong to no upload or to a purged one
+func (check *fsck) infoFiles() error {
+	if check.store.MetadataInDatabase {
+		return check.infoRows()
+	}
+
+	return walkFiles(filepath.Join(check.store.BasePath, "meta"), ".info", func(path string) error {
+		check.report.Infos++
+		id := strings.TrimSuffix(filepath.Base(path), ".info")
+
+		if row := check.rows[id]; row != nil && !row.Purged {
+			return nil
+		}
+
+		check.remove(FsckProblem{Kind: FsckOrphanInfo, ID: id, Path: path})
+		return nil
+	})
+}
+
+// infoRows is infoFiles for uploads whose info is kept in the database
+func (check *fsck) infoRows() error {
+	var ids []string
+	err := check.store.DBConn.DB.Select(&ids, `SELECT id FROM upload_info`)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		check.report.Infos++
+		if row := check.rows[id]; row != nil && !row.Purged {
+			continue
+		}
+
+		problem := FsckProblem{Kind: FsckOrphanInfo, ID: id}
+		if !check.options.Repair {
+			check.add(problem, nil)
+			continue
+		}
+		err := check.store.removeInfo(id)
+		if err == nil {
+			problem.Repair = "removed row"
+		}
+		check.add(problem, err)
+	}
+	return nil
+}
+
+// remove records a problem fixed by removing its file
+func (check *fsck) remove(problem FsckProblem) {
+	if !check.options.Repair {
+		check.add(problem, nil)
+		return
+	}
+
+	// the file may already be gone when a repair moved it
+	if _, err := os.Stat(problem.Path); os.IsNotExist(err) {
+		return
+	}
+
+	err := RemoveWithDirs(problem.Path, check.store.BasePath)
+	if err == nil {
+		problem.Repair = "removed file"
+	}
+	check.add(problem, err)
+}
+
+// purge records a problem fixed by purging the upload of row
+func (check *fsck) purge(problem FsckProblem, row *fsckRow) {
+	err := check.store.Purge(row.ID)
+	if err == nil {
+		row.Deleted = true
+		row.Purged = true
+		problem.Repair = "purged upload"
+	}
+	check.add(problem, err)
+}
+
+func (check *fsck) add(problem FsckProblem, err error) {
+	if err != nil {
+		problem.Error = err.Error()
+	}
+	check.report.Problems = append(check.report.Problems, problem)
+
+	event := check.store.log.Warn()
+	if problem.Repair != "" {
+		event = check.store.log.Info()
+	} else if err != nil {
+		event = check.store.log.Error().Err(err)
+	}
+	event.
+		Str("event", "fsck_"+problem.Kind).
+		Str("id", problem.ID).
+		Str("path", problem.Path).
+		Str("repair", problem.Repair).
+		Msg("Storage inconsistency")
+}
+
+// liveRows returns the rows of uploads that have not been purged
+func liveRows(rows []*fsckRow) []*fsckRow {
+	live := make([]*fsckRow, 0, len(rows))
+	for _, row := range rows {
+		if !row.Purged {
+			live = append(live, row)
+		}
+	}
+	return live
+}
+
+// walkFiles calls fn for each file under root with the given extension
+func walkFiles(root, ext string, fn func(path string) error) error {
+	// collect the paths first, as fn may remove files and directories
+	var paths []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() && filepath.Ext(path) == ext {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if err := fn(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
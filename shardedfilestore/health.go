@@ -0,0 +1,55 @@
+package shardedfilestore
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// DiskSpace is the size of the filesystem holding the storage
+type DiskSpace struct {
+	Free  uint64 `json:"free_bytes"` // available to the server
+	Total uint64 `json:"total_bytes"`
+}
+
+// ErrDiskSpaceUnsupported is returned by DiskSpace on platforms where the
+// filesystem size can't be read
+var ErrDiskSpaceUnsupported = errors.New("disk space is not available on this platform")
+
+// DiskSpace returns the size of the filesystem holding the storage
+func (store *ShardedFileStore) DiskSpace() (*DiskSpace, error) {
+	return diskSpace(store.BasePath)
+}
+
+// Ping runs a trivial query to check the database is reachable
+func (store *ShardedFileStore) Ping(ctx context.Context) error {
+	var one int
+	return store.DBConn.DB.QueryRowContext(ctx, `SELECT 1`).Scan(&one)
+}
+
+// CheckWritable checks that files can be created under incomplete/ and
+// complete/, returning the error of each directory that failed
+func (store *ShardedFileStore) CheckWritable() map[string]error {
+	failed := make(map[string]error)
+	for _, dir := range []string{"incomplete", "complete"} {
+		if err := checkWritable(filepath.Join(store.BasePath, dir)); err != nil {
+			failed[dir] = err
+		}
+	}
+	return failed
+}
+
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, defaultDirectoryPerm); err != nil {
+		return err
+	}
+	// the name doesn't end in .bin, so fsck ignores files left by a crash
+	file, err := ioutil.TempFile(dir, ".healthcheck-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
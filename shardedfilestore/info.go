@@ -0,0 +1,203 @@
+package shardedfilestore
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tus/tusd/pkg/handler"
+
+	"github.com/kiwiirc/plugin-fileuploader/db"
+)
+
+// InfoTransfer counts the upload infos copied between .info files and the
+// upload_info table
+type InfoTransfer struct {
+	Copied  int `json:"copied"`
+	Skipped int `json:"skipped"` // .info files of unknown or purged uploads
+}
+
+// readInfoRow reads the info of an upload from the upload_info table
+func (store ShardedFileStore) readInfoRow(id string) (info handler.FileInfo, err error) {
+	var data string
+	err = store.DBConn.DB.Get(&data, store.DBConn.DB.Rebind(`
+		SELECT info
+		FROM upload_info
+		WHERE id = ?
+	`), id)
+	if err == sql.ErrNoRows {
+		return info, handler.ErrNotFound
+	} else if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal([]byte(data), &info)
+	return info, err
+}
+
+// writeInfoRow replaces the info of an upload in the upload_info table
+func writeInfoRow(conn *db.DatabaseConnection, id string, data []byte) error {
+	tx, err := conn.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(tx.Rebind(`DELETE FROM upload_info WHERE id = ?`), id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(tx.Rebind(`INSERT INTO upload_info(id, info) VALUES (?, ?)`), id, string(data))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// importInfoFile copies the .info file of an upload that has no row in the
+// upload_info table, so that stores switched to keeping metadata in the
+// database without running `metadata import` keep serving their uploads
+func (store ShardedFileStore) importInfoFile(id string) (info handler.FileInfo, err error) {
+	data, err := ioutil.ReadFile(store.infoPath(id))
+	if os.IsNotExist(err) {
+		return info, handler.ErrNotFound
+	} else if err != nil {
+		return info, err
+	}
+	if err = json.Unmarshal(data, &info); err != nil {
+		return info, err
+	}
+
+	if err = writeInfoRow(store.DBConn, id, data); err != nil {
+		return info, err
+	}
+	store.log.Info().
+		Str("event", "info_imported").
+		Str("id", id).
+		Msg("Imported .info file of upload into the database")
+
+	return info, nil
+}
+
+// removeInfo removes the info of a purged upload
+func (store *ShardedFileStore) removeInfo(id string) error {
+	if !store.MetadataInDatabase {
+		return RemoveWithDirs(store.infoPath(id), store.BasePath)
+	}
+
+	_, err := store.DBConn.DB.Exec(store.DBConn.DB.Rebind(`DELETE FROM upload_info WHERE id = ?`), id)
+	if err != nil {
+		return err
+	}
+	// an .info file left from before the switch would be imported again
+	return RemoveWithDirs(store.infoPath(id), store.BasePath)
+}
+
+// ImportInfoFiles copies the .info files under meta/ into the upload_info
+// table, replacing the infos already there. The files are left in place.
+func (store *ShardedFileStore) ImportInfoFiles() (*InfoTransfer, error) {
+	return store.importInfoFiles(store.DBConn)
+}
+
+func (store *ShardedFileStore) importInfoFiles(conn *db.DatabaseConnection) (*InfoTransfer, error) {
+	var ids []string
+	err := conn.DB.Select(&ids, `SELECT id FROM uploads WHERE purged = 0`)
+	if err != nil {
+		return nil, err
+	}
+	live := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		live[id] = true
+	}
+
+	result := &InfoTransfer{}
+	err = walkFiles(filepath.Join(store.BasePath, "meta"), ".info", func(path string) error {
+		id := strings.TrimSuffix(filepath.Base(path), ".info")
+		if !live[id] {
+			store.log.Warn().
+				Str("event", "info_import_skipped").
+				Str("path", path).
+				Msg("Skipping .info file of unknown or purged upload")
+			result.Skipped++
+			return nil
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var info handler.FileInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+
+		if err := writeInfoRow(conn, id, data); err != nil {
+			return err
+		}
+		result.Copied++
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	store.log.Info().
+		Str("event", "info_imported").
+		Int("copied", result.Copied).
+		Int("skipped", result.Skipped).
+		Msg("Imported .info files into the database")
+
+	return result, nil
+}
+
+// ExportInfoFiles writes the infos of the upload_info table to .info files
+// under meta/, replacing the files already there
+func (store *ShardedFileStore) ExportInfoFiles() (*InfoTransfer, error) {
+	var rows []struct {
+		ID   string `db:"id"`
+		Info string `db:"info"`
+	}
+	err := store.DBConn.DB.Select(&rows, `
+		SELECT upload_info.id, upload_info.info
+		FROM upload_info
+		JOIN uploads ON uploads.id = upload_info.id
+		WHERE uploads.purged = 0
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &InfoTransfer{}
+	for _, row := range rows {
+		if err := os.MkdirAll(store.metaDir(row.ID), defaultDirectoryPerm); err != nil {
+			return result, err
+		}
+		if err := ioutil.WriteFile(store.infoPath(row.ID), []byte(row.Info), defaultFilePerm); err != nil {
+			return result, err
+		}
+		result.Copied++
+	}
+
+	store.log.Info().
+		Str("event", "info_exported").
+		Int("copied", result.Copied).
+		Msg("Exported database upload infos to .info files")
+
+	return result, nil
+}
+
+// backfillUploadInfo imports the existing .info files when upgrading a store
+// that keeps upload infos in the database
+func (store *ShardedFileStore) backfillUploadInfo(conn *db.DatabaseConnection) (int, error) {
+	if !store.MetadataInDatabase {
+		return 0, nil
+	}
+	result, err := store.importInfoFiles(conn)
+	if err != nil {
+		return 0, err
+	}
+	return result.Copied, nil
+}
@@ -0,0 +1,283 @@
+package shardedfilestore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// layoutFile is the name of the file recording the layout of a storage root
+const layoutFile = "layout.json"
+
+// minimum length of the names sharded by a layout, upload ids are 32 hex characters
+const shardedNameLength = 32
+
+// Layout describes how files are spread over directories, by taking the
+// first Depth*Width characters of their upload id or hash
+type Layout struct {
+	Depth int `json:"depth"` // Number of directory levels
+	Width int `json:"width"` // Characters of the name used for each level
+}
+
+// ErrLayoutMismatch is returned when the storage was written with a different
+// layout than the configured one
+var ErrLayoutMismatch = errors.New("storage layout does not match the config, run the reshard command")
+
+// recordedLayout is the content of the layout file
+type recordedLayout struct {
+	Layout
+	// Layout being moved to by an unfinished reshard
+	ReshardTo *Layout `json:"reshard_to,omitempty"`
+}
+
+func (layout Layout) String() string {
+	return fmt.Sprintf("depth %d, width %d", layout.Depth, layout.Width)
+}
+
+// Validate checks that the layout can shard every name
+func (layout Layout) Validate() error {
+	if layout.Depth < 0 || layout.Width < 1 {
+		return fmt.Errorf("invalid storage layout: %s", layout)
+	}
+	if layout.Depth*layout.Width > shardedNameLength {
+		return fmt.Errorf("invalid storage layout: %s uses more than %d characters", layout, shardedNameLength)
+	}
+	return nil
+}
+
+// shards generates the directory hierarchy of name
+func (layout Layout) shards(name string) string {
+	if len(name) < layout.Depth*layout.Width {
+		panic("name is too short for requested storage layout")
+	}
+	shards := make([]string, layout.Depth)
+	for n := range shards {
+		shards[n] = name[n*layout.Width : (n+1)*layout.Width]
+	}
+	return filepath.Join(shards...)
+}
+
+// CheckLayout makes sure that the storage at basePath uses layout. Storage
+// without a recorded layout is assumed to use it, and it is recorded.
+func CheckLayout(basePath string, layout Layout) error {
+	if err := layout.Validate(); err != nil {
+		return err
+	}
+
+	recorded, err := readLayout(basePath)
+	if err != nil {
+		return err
+	}
+	if recorded == nil {
+		return writeLayout(basePath, &recordedLayout{Layout: layout})
+	}
+
+	if recorded.ReshardTo != nil {
+		return fmt.Errorf("resharding storage to %s has not finished, run the reshard command again", recorded.ReshardTo)
+	}
+	if recorded.Layout != layout {
+		return fmt.Errorf("%w: storage has %s, config has %s", ErrLayoutMismatch, recorded.Layout, layout)
+	}
+	return nil
+}
+
+func readLayout(basePath string) (*recordedLayout, error) {
+	data, err := ioutil.ReadFile(filepath.Join(basePath, layoutFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var recorded recordedLayout
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", layoutFile, err)
+	}
+	return &recorded, nil
+}
+
+// writeLayout replaces the layout file, so that it is never left half written
+func writeLayout(basePath string, recorded *recordedLayout) error {
+	data, err := json.MarshalIndent(recorded, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(basePath, defaultDirectoryPerm); err != nil {
+		return err
+	}
+	path := filepath.Join(basePath, layoutFile)
+	if err := ioutil.WriteFile(path+".tmp", append(data, '\n'), defaultFilePerm); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// ReshardResult counts the files moved by Reshard
+type ReshardResult struct {
+	From  *Layout `json:"from"` // nil when storage had no recorded layout
+	To    Layout  `json:"to"`
+	Blobs int     `json:"blobs"`
+	Infos int     `json:"infos"`
+}
+
+// Reshard moves the files under complete/ and meta/ to the store's layout.
+// Where each file belongs only depends on its name, so an interrupted reshard
+// can be resumed by running it again. The server must not be running.
+func (store *ShardedFileStore) Reshard() (*ReshardResult, error) {
+	if err := store.Layout.Validate(); err != nil {
+		return nil, err
+	}
+
+	recorded, err := readLayout(store.BasePath)
+	if err != nil {
+		return nil, err
+	}
+	result := &ReshardResult{To: store.Layout}
+	if recorded == nil {
+		// storage from before layouts were recorded, files are moved
+		// from wherever they are
+		recorded = &recordedLayout{Layout: store.Layout}
+	} else {
+		result.From = &recorded.Layout
+	}
+	if recorded.ReshardTo != nil && *recorded.ReshardTo != store.Layout {
+		return nil, fmt.Errorf("resharding storage to %s has not finished, finish it before resharding to %s", recorded.ReshardTo, store.Layout)
+	}
+
+	// mark the reshard as started, which stops the server from starting
+	// until it has finished
+	recorded.ReshardTo = &store.Layout
+	if err := writeLayout(store.BasePath, recorded); err != nil {
+		return nil, err
+	}
+
+	complete := filepath.Join(store.BasePath, "complete")
+	err = walkFiles(complete, ".bin", func(path string) error {
+		hash := strings.TrimSuffix(filepath.Base(path), ".bin")
+		if len(hash) < shardedNameLength {
+			store.log.Warn().Str("path", path).Msg("Skipping unknown file")
+			return nil
+		}
+		moved, err := store.moveToLayout(path, filepath.Join(complete, store.shards(hash), hash+".bin"))
+		if moved {
+			result.Blobs++
+		}
+		return err
+	})
+	if err != nil {
+		return result, err
+	}
+
+	meta := filepath.Join(store.BasePath, "meta")
+	err = walkFiles(meta, ".info", func(path string) error {
+		id := strings.TrimSuffix(filepath.Base(path), ".info")
+		if len(id) < shardedNameLength {
+			store.log.Warn().Str("path", path).Msg("Skipping unknown file")
+			return nil
+		}
+		moved, err := store.moveToLayout(path, store.infoPath(id))
+		if err != nil {
+			return err
+		}
+		if moved {
+			result.Infos++
+		}
+		if store.MetadataInDatabase {
+			// left over from before the infos were imported
+			return nil
+		}
+		if err := store.updateInfoPath(id); err != nil {
+			return fmt.Errorf("updating %s: %w", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	if store.MetadataInDatabase {
+		var ids []string
+		if err := store.DBConn.DB.Select(&ids, `SELECT id FROM upload_info`); err != nil {
+			return result, err
+		}
+		for _, id := range ids {
+			if err := store.updateInfoPath(id); err != nil {
+				return result, fmt.Errorf("updating info of %s: %w", id, err)
+			}
+		}
+	}
+
+	if err := writeLayout(store.BasePath, &recordedLayout{Layout: store.Layout}); err != nil {
+		return result, err
+	}
+
+	store.log.Info().
+		Str("event", "resharded").
+		Interface("from", result.From).
+		Interface("to", result.To).
+		Int("blobs", result.Blobs).
+		Int("infos", result.Infos).
+		Msg("Moved storage to new layout")
+
+	return result, nil
+}
+
+// moveToLayout moves a file to where it belongs in the current layout,
+// removing the directories it leaves empty
+func (store *ShardedFileStore) moveToLayout(path, newPath string) (moved bool, err error) {
+	if path == newPath {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(newPath), defaultDirectoryPerm); err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(newPath); err == nil {
+		// blobs are named by their hash, so a blob already in place has
+		// the same content
+		if filepath.Ext(path) != ".bin" {
+			return false, fmt.Errorf("cannot move %s, %s already exists", path, newPath)
+		}
+		if err := os.Remove(path); err != nil {
+			return false, err
+		}
+	} else if err := os.Rename(path, newPath); err != nil {
+		return false, err
+	}
+
+	return true, removeEmptyParents(path, store.BasePath)
+}
+
+// updateInfoPath points the Storage.Path of a finished upload's info at its
+// blob in the current layout
+func (store *ShardedFileStore) updateInfoPath(id string) error {
+	info, err := store.readInfo(id)
+	if err != nil {
+		return err
+	}
+
+	path := info.Storage["Path"]
+	hash := strings.TrimSuffix(filepath.Base(path), ".bin")
+	if filepath.Base(filepath.Dir(path)) == "incomplete" || len(hash) < shardedNameLength {
+		return nil
+	}
+
+	newPath := filepath.Join(store.BasePath, "complete", store.shards(hash), hash+".bin")
+	if path == newPath {
+		return nil
+	}
+	info.Storage["Path"] = newPath
+
+	upload := &fileUpload{
+		info:     info,
+		store:    *store,
+		infoPath: store.infoPath(id),
+	}
+	return upload.writeInfo()
+}
@@ -0,0 +1,138 @@
+package shardedfilestore
+
+import (
+	"time"
+
+	"github.com/tus/tusd/pkg/handler"
+)
+
+// Report is an abuse report about an upload
+type Report struct {
+	ID              string `db:"id" json:"id"`
+	UploadID        string `db:"upload_id" json:"upload_id"`
+	ReporterIP      string `db:"reporter_ip" json:"reporter_ip"`
+	ReporterAccount string `db:"reporter_account" json:"reporter_account"`
+	ReporterIssuer  string `db:"reporter_issuer" json:"reporter_issuer"`
+	Reason          string `db:"reason" json:"reason"`
+	CreatedAt       int64  `db:"created_at" json:"created_at"`
+}
+
+// reporterKey identifies who made a report, by account when they were
+// identified and by IP address otherwise
+func (report *Report) reporterKey() string {
+	if report.ReporterAccount != "" {
+		return report.ReporterIssuer + "/" + report.ReporterAccount
+	}
+	return report.ReporterIP
+}
+
+// AddReport stores an abuse report about a finished upload, filling in its id
+// and creation time. It returns the number of different reporters of the
+// upload. Once threshold different people have reported it the upload is
+// quarantined, unless an admin has released it from quarantine before, and
+// quarantined is true for the report that quarantined it. A threshold of 0
+// never quarantines.
+func (store *ShardedFileStore) AddReport(report *Report, threshold int) (reporters int, quarantined bool, err error) {
+	state, err := store.lookupState(report.UploadID)
+	if err != nil {
+		return 0, false, err
+	}
+	if !state.Finished {
+		return 0, false, handler.ErrNotFound
+	}
+	if state.Deleted {
+		return 0, false, ErrUploadGone
+	}
+
+	report.ID = Uid()
+	report.CreatedAt = time.Now().Unix()
+
+	tx, err := store.DBConn.DB.Beginx()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	// updating the upload first locks its row, so that concurrent reports
+	// are counted one after the other and each sees the reports committed
+	// before it
+	res, err := tx.Exec(tx.Rebind(`
+		UPDATE uploads
+		SET report_count = report_count + 1
+		WHERE id = ? AND deleted = 0
+	`), report.UploadID)
+	if err != nil {
+		return 0, false, err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return 0, false, err
+	}
+	if count == 0 {
+		return 0, false, ErrUploadGone
+	}
+
+	_, err = tx.NamedExec(`
+		INSERT INTO reports(id, upload_id, reporter_ip, reporter_account, reporter_issuer, reason, created_at)
+		VALUES (:id, :upload_id, :reporter_ip, :reporter_account, :reporter_issuer, :reason, :created_at)
+	`, report)
+	if err != nil {
+		return 0, false, err
+	}
+
+	var reports []Report
+	err = tx.Select(&reports, tx.Rebind(`
+		SELECT id, upload_id, reporter_ip, reporter_account, reporter_issuer, reason, created_at
+		FROM reports
+		WHERE upload_id = ?
+	`), report.UploadID)
+	if err != nil {
+		return 0, false, err
+	}
+
+	seen := make(map[string]bool)
+	for _, existing := range reports {
+		seen[existing.reporterKey()] = true
+	}
+	reporters = len(seen)
+
+	if threshold > 0 && reporters >= threshold {
+		res, err = tx.Exec(tx.Rebind(`
+			UPDATE uploads
+			SET quarantined = 1
+			WHERE id = ? AND quarantined = 0 AND quarantine_released = 0
+		`), report.UploadID)
+		if err != nil {
+			return 0, false, err
+		}
+		count, err = res.RowsAffected()
+		if err != nil {
+			return 0, false, err
+		}
+		quarantined = count > 0
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, false, err
+	}
+
+	if quarantined {
+		store.log.Info().
+			Str("event", "quarantined").
+			Str("id", report.UploadID).
+			Msg("Changed quarantine state of upload")
+	}
+	return reporters, quarantined, nil
+}
+
+// Reports returns the abuse reports about an upload, oldest first
+func (store *ShardedFileStore) Reports(uploadID string) (reports []Report, err error) {
+	reports = make([]Report, 0)
+	err = store.DBConn.DB.Select(&reports, store.DBConn.DB.Rebind(`
+		SELECT id, upload_id, reporter_ip, reporter_account, reporter_issuer, reason, created_at
+		FROM reports
+		WHERE upload_id = ?
+		ORDER BY created_at
+	`), uploadID)
+	return
+}
@@ -1,13 +1,186 @@
 package shardedfilestore
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
 
 	migrate "github.com/rubenv/sql-migrate"
+
+	"github.com/kiwiirc/plugin-fileuploader/db"
 )
 
-func (store *ShardedFileStore) initDB() {
-	migrations := &migrate.MemoryMigrationSource{
+// ErrPendingMigrations is returned on startup when migrations need to be
+// applied and Database.AutoMigrate is off
+var ErrPendingMigrations = errors.New("database schema is out of date, run the migrate up command")
+
+// MigrationStatus describes a schema migration and whether it has been applied
+type MigrationStatus struct {
+	ID         string     `json:"id"`
+	AppliedAt  *time.Time `json:"applied_at,omitempty"`
+	Reversible bool       `json:"reversible"`
+}
+
+// PlannedMigration is a schema migration about to be applied or reverted,
+// with the statements it would run
+type PlannedMigration struct {
+	ID         string   `json:"id"`
+	Statements []string `json:"statements"`
+}
+
+// CheckSchema makes sure that the database schema is up to date before the
+// store is used, either by migrating it or by refusing to go on
+func (store *ShardedFileStore) CheckSchema(autoMigrate bool) error {
+	if autoMigrate {
+		_, err := store.Migrate(migrate.Up, 0)
+		return err
+	}
+
+	pending, err := store.PlanMigrations(migrate.Up, 0)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		ids := make([]string, len(pending))
+		for i, migration := range pending {
+			ids[i] = migration.ID
+		}
+		return fmt.Errorf("%w: pending migrations %s", ErrPendingMigrations, strings.Join(ids, ", "))
+	}
+
+	backfills, err := pendingBackfills(store.DBConn)
+	if err != nil {
+		return err
+	}
+	if len(backfills) > 0 {
+		return fmt.Errorf("%w: pending backfills of migrations %s", ErrPendingMigrations, strings.Join(backfills, ", "))
+	}
+	return nil
+}
+
+// MigrationStatus lists every schema migration, oldest first
+func (store *ShardedFileStore) MigrationStatus() ([]MigrationStatus, error) {
+	records, err := migrate.GetMigrationRecords(store.DBConn.DB.DB, store.DBConn.DriverName)
+	if err != nil {
+		return nil, err
+	}
+	appliedAt := make(map[string]time.Time)
+	for _, record := range records {
+		appliedAt[record.Id] = record.AppliedAt
+	}
+
+	migrations, err := store.migrations().FindMigrations()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, len(migrations))
+	for i, migration := range migrations {
+		statuses[i] = MigrationStatus{
+			ID:         migration.Id,
+			Reversible: len(migration.Down) > 0,
+		}
+		if at, ok := appliedAt[migration.Id]; ok {
+			statuses[i].AppliedAt = &at
+		}
+	}
+	return statuses, nil
+}
+
+// PlanMigrations returns the migrations that Migrate would apply or revert
+func (store *ShardedFileStore) PlanMigrations(direction migrate.MigrationDirection, max int) ([]PlannedMigration, error) {
+	migrations := forDialect(store.DBConn.DriverName, store.migrations())
+	planned, _, err := migrate.PlanMigration(store.DBConn.DB.DB, store.DBConn.DriverName, migrations, direction, max)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := make([]PlannedMigration, len(planned))
+	for i, migration := range planned {
+		plan[i] = PlannedMigration{ID: migration.Id, Statements: migration.Queries}
+	}
+	return plan, nil
+}
+
+// Migrate applies, or reverts, up to max schema migrations, all of them when
+// max is 0. It returns the ids of the migrations run.
+func (store *ShardedFileStore) Migrate(direction migrate.MigrationDirection, max int) ([]string, error) {
+	return store.migrateDB(store.DBConn, direction, max)
+}
+
+// migrateDB runs schema migrations on a database one at a time, logging how
+// long each one takes
+func (store *ShardedFileStore) migrateDB(conn *db.DatabaseConnection, direction migrate.MigrationDirection, max int) ([]string, error) {
+	migrations := forDialect(conn.DriverName, store.migrations())
+	dirName := "up"
+	if direction == migrate.Down {
+		dirName = "down"
+	}
+
+	// retry the backfills left by an earlier run that failed
+	if direction == migrate.Up {
+		if err := store.runBackfills(conn); err != nil {
+			return nil, err
+		}
+	}
+
+	var done []string
+	for max <= 0 || len(done) < max {
+		next, _, err := migrate.PlanMigration(conn.DB.DB, conn.DriverName, migrations, direction, 1)
+		if err != nil {
+			return done, err
+		}
+		if len(next) == 0 {
+			break
+		}
+
+		id := next[0].Id
+		if direction == migrate.Down && len(next[0].Down) == 0 {
+			return done, fmt.Errorf("migration %s cannot be reverted", id)
+		}
+
+		store.log.Info().
+			Str("event", "schema_migration_started").
+			Str("id", id).
+			Str("direction", dirName).
+			Msg("Running schema migration")
+
+		started := time.Now()
+		_, err = migrate.ExecMax(conn.DB.DB, conn.DriverName, migrations, direction, 1)
+		if err != nil {
+			store.log.Error().
+				Err(err).
+				Str("event", "schema_migration_failed").
+				Str("id", id).
+				Str("direction", dirName).
+				Dur("duration", time.Since(started)).
+				Msg("Schema migration failed")
+			return done, fmt.Errorf("migration %s: %w", id, err)
+		}
+
+		if direction == migrate.Up {
+			if err := store.runBackfills(conn); err != nil {
+				return done, err
+			}
+		}
+
+		store.log.Info().
+			Str("event", "schema_migration").
+			Str("id", id).
+			Str("direction", dirName).
+			Dur("duration", time.Since(started)).
+			Msg("Ran schema migration")
+		done = append(done, id)
+	}
+	return done, nil
+}
+
+// migrations returns the schema migrations of the database
+func (store *ShardedFileStore) migrations() *migrate.MemoryMigrationSource {
+	return &migrate.MemoryMigrationSource{
 		Migrations: []*migrate.Migration{
 			{
 				Id: "1",
@@ -101,17 +274,374 @@ func (store *ShardedFileStore) initDB() {
 					`ALTER TABLE new_uploads RENAME TO uploads;`,
 				},
 			},
+			{
+				Id: "6",
+				Up: []string{
+					`ALTER TABLE uploads ADD deleted_at INTEGER(8);`,
+					`ALTER TABLE uploads ADD purged INTEGER(1) DEFAULT 0 NOT NULL;`,
+					// uploads deleted before the trash existed have already lost their files
+					`UPDATE uploads SET purged = 1 WHERE deleted = 1;`,
+				},
+			},
+			{
+				Id: "7",
+				Up: []string{
+					`ALTER TABLE uploads ADD deletion_token_hash VARCHAR(64);`,
+				},
+			},
+			{
+				Id: "8",
+				Up: []string{
+					`ALTER TABLE uploads ADD max_downloads INTEGER DEFAULT 0 NOT NULL;`,
+					`ALTER TABLE uploads ADD download_count INTEGER DEFAULT 0 NOT NULL;`,
+				},
+			},
+			{
+				Id: "9",
+				Up: []string{
+					`ALTER TABLE uploads ADD password_hash VARCHAR(255);`,
+				},
+			},
+			{
+				Id: "10",
+				Up: []string{
+					`ALTER TABLE uploads ADD private INTEGER(1) DEFAULT 0 NOT NULL;`,
+				},
+			},
+			{
+				Id: "11",
+				Up: []string{
+					`ALTER TABLE uploads ADD bytes_served INTEGER(8) DEFAULT 0 NOT NULL;`,
+					`ALTER TABLE uploads ADD last_accessed_at INTEGER(8);`,
+				},
+			},
+			{
+				Id: "12",
+				Up: []string{
+					`
+					CREATE TABLE blocklist(
+						sha256sum VARCHAR(64) PRIMARY KEY,
+						reason TEXT NOT NULL,
+						created_at INTEGER(8)
+					);`,
+				},
+				Down: []string{"DROP TABLE blocklist;"},
+			},
+			{
+				Id: "13",
+				Up: []string{
+					`ALTER TABLE uploads ADD phash VARCHAR(16);`,
+					`ALTER TABLE uploads ADD quarantined INTEGER(1) DEFAULT 0 NOT NULL;`,
+					`
+					CREATE TABLE phash_blocklist(
+						phash VARCHAR(16) PRIMARY KEY,
+						reason TEXT NOT NULL,
+						created_at INTEGER(8)
+					);`,
+				},
+				Down: []string{
+					"DROP TABLE phash_blocklist;",
+					"ALTER TABLE uploads DROP COLUMN quarantined;",
+					"ALTER TABLE uploads DROP COLUMN phash;",
+				},
+			},
+			{
+				Id: "14",
+				Up: []string{
+					`
+					CREATE TABLE reports(
+						id VARCHAR(36) PRIMARY KEY,
+						upload_id VARCHAR(36) NOT NULL,
+						reporter_ip VARCHAR(45),
+						reporter_account VARCHAR(255) DEFAULT '' NOT NULL,
+						reporter_issuer VARCHAR(255) DEFAULT '' NOT NULL,
+						reason TEXT NOT NULL,
+						created_at INTEGER(8)
+					);`,
+					`CREATE INDEX reports_upload_id ON reports(upload_id);`,
+				},
+				Down: []string{"DROP TABLE reports;"},
+			},
+			{
+				Id: "15",
+				Up: []string{
+					`
+					CREATE TABLE bans(
+						id VARCHAR(36) PRIMARY KEY,
+						ip_range VARCHAR(49) DEFAULT '' NOT NULL,
+						jwt_account VARCHAR(255) DEFAULT '' NOT NULL,
+						jwt_issuer VARCHAR(255) DEFAULT '' NOT NULL,
+						reason TEXT NOT NULL,
+						created_by VARCHAR(255) DEFAULT '' NOT NULL,
+						created_at INTEGER(8),
+						expires_at INTEGER(8)
+					);`,
+				},
+				Down: []string{"DROP TABLE bans;"},
+			},
+			{
+				Id: "16",
+				Up: []string{
+					// backfills still to run after their migration, see
+					// runBackfills
+					`
+					CREATE TABLE IF NOT EXISTS pending_backfills(
+						id VARCHAR(36) PRIMARY KEY
+					);`,
+					`ALTER TABLE uploads ADD filename TEXT;`,
+					`ALTER TABLE uploads ADD filetype VARCHAR(255);`,
+					`ALTER TABLE uploads ADD size INTEGER(8);`,
+					`ALTER TABLE uploads ADD completed_at INTEGER(8);`,
+					// refined from the .info files by backfillUploadColumns
+					`UPDATE uploads SET completed_at = created_at WHERE sha256sum IS NOT NULL;`,
+					`CREATE INDEX uploads_filetype ON uploads(filetype);`,
+					`CREATE INDEX uploads_size ON uploads(size);`,
+					`CREATE INDEX uploads_completed_at ON uploads(completed_at);`,
+					`INSERT INTO pending_backfills(id) VALUES ('16');`,
+				},
+				Down: []string{
+					"DROP INDEX uploads_completed_at;",
+					"DROP INDEX uploads_size;",
+					"DROP INDEX uploads_filetype;",
+					"ALTER TABLE uploads DROP COLUMN completed_at;",
+					"ALTER TABLE uploads DROP COLUMN size;",
+					"ALTER TABLE uploads DROP COLUMN filetype;",
+					"ALTER TABLE uploads DROP COLUMN filename;",
+					"DROP TABLE pending_backfills;",
+				},
+			},
+			{
+				Id: "17",
+				Up: []string{
+					`
+					CREATE TABLE upload_info(
+						id VARCHAR(36) PRIMARY KEY,
+						info TEXT NOT NULL
+					);`,
+					`INSERT INTO pending_backfills(id) VALUES ('17');`,
+				},
+				Down: []string{
+					"DELETE FROM pending_backfills WHERE id = '17';",
+					"DROP TABLE upload_info;",
+				},
+			},
+			{
+				Id: "18",
+				Up: []string{
+					// report_count is also updated first by AddReport to lock the upload
+					`ALTER TABLE uploads ADD report_count INTEGER DEFAULT 0 NOT NULL;`,
+					`ALTER TABLE uploads ADD quarantine_released INTEGER(1) DEFAULT 0 NOT NULL;`,
+					`
+					UPDATE uploads
+						SET report_count = (SELECT COUNT(*) FROM reports WHERE reports.upload_id = uploads.id)
+					;`,
+				},
+				Down: []string{
+					"ALTER TABLE uploads DROP COLUMN quarantine_released;",
+					"ALTER TABLE uploads DROP COLUMN report_count;",
+				},
+			},
 		},
 	}
+}
 
-	n, err := migrate.Exec(store.DBConn.DB.DB, store.DBConn.DriverName, migrations, migrate.Up)
+// migrationBackfills fill in the data that migrations can't compute in SQL,
+// run right after the migration of the same id has been applied. Such a
+// migration inserts its id into pending_backfills, which is removed once the
+// backfill succeeds, so that a backfill that failed is run again.
+var migrationBackfills = map[string]func(store *ShardedFileStore, conn *db.DatabaseConnection) (int, error){
+	"16": (*ShardedFileStore).backfillUploadColumns,
+	"17": (*ShardedFileStore).backfillUploadInfo,
+}
+
+// pendingBackfills returns the ids of the migrations whose backfill has not
+// completed yet
+func pendingBackfills(conn *db.DatabaseConnection) ([]string, error) {
+	// the table is created by the first migration with a backfill
+	records, err := migrate.GetMigrationRecords(conn.DB.DB, conn.DriverName)
 	if err != nil {
-		store.log.Fatal().Err(err).Msg("Failed to apply migrations")
+		return nil, err
+	}
+	created := false
+	for _, record := range records {
+		if record.Id == "16" {
+			created = true
+		}
 	}
+	if !created {
+		return nil, nil
+	}
+
+	var ids []string
+	err = conn.DB.Select(&ids, `SELECT id FROM pending_backfills ORDER BY id`)
+	return ids, err
+}
+
+// runBackfills runs the pending backfills of the migrations applied so far
+func (store *ShardedFileStore) runBackfills(conn *db.DatabaseConnection) error {
+	ids, err := pendingBackfills(conn)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		backfill := migrationBackfills[id]
+		if backfill == nil {
+			return fmt.Errorf("migration %s has no backfill", id)
+		}
+
+		filled, err := backfill(store, conn)
+		if err != nil {
+			store.log.Error().
+				Err(err).
+				Str("event", "schema_backfill_failed").
+				Str("id", id).
+				Msg("Schema migration backfill failed")
+			return fmt.Errorf("migration %s backfill: %w", id, err)
+		}
+
+		_, err = conn.DB.Exec(conn.DB.Rebind(`DELETE FROM pending_backfills WHERE id = ?`), id)
+		if err != nil {
+			return err
+		}
 
-	if n > 0 {
 		store.log.Info().
-			Str("event", "schema_migrations").
-			Int("count", n).Msg("Applied schema migrations")
+			Str("event", "schema_backfill").
+			Str("id", id).
+			Int("rows", filled).
+			Msg("Backfilled rows")
+	}
+	return nil
+}
+
+// backfillUploadColumns copies the filename, type and size of existing
+// uploads from their .info files. The .info file is last written when an
+// upload finishes, so its modification time is taken as the completion time.
+// Purged uploads have lost their .info file and are left empty.
+func (store *ShardedFileStore) backfillUploadColumns(conn *db.DatabaseConnection) (int, error) {
+	var rows []struct {
+		ID        string `db:"id"`
+		CreatedAt int64  `db:"created_at"`
+		Finished  bool   `db:"finished"`
+	}
+	err := conn.DB.Select(&rows, `
+		SELECT id, COALESCE(created_at, 0) AS created_at, sha256sum IS NOT NULL AS finished
+		FROM uploads
+		WHERE purged = 0
+	`)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := conn.DB.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	filled := 0
+	for _, row := range rows {
+		info, err := store.readInfoFile(row.ID)
+		if err != nil {
+			store.log.Warn().
+				Err(err).
+				Str("event", "backfill_skipped").
+				Str("id", row.ID).
+				Msg("Could not read upload info")
+			continue
+		}
+
+		var size, completedAt sql.NullInt64
+		if !info.SizeIsDeferred {
+			size = sql.NullInt64{Int64: info.Size, Valid: true}
+		}
+		if row.Finished {
+			completedAt = sql.NullInt64{Int64: row.CreatedAt, Valid: true}
+			if stat, err := os.Stat(store.infoPath(row.ID)); err == nil && stat.ModTime().Unix() > row.CreatedAt {
+				completedAt.Int64 = stat.ModTime().Unix()
+			}
+		}
+
+		_, err = tx.Exec(tx.Rebind(`
+			UPDATE uploads
+			SET filename = ?,
+			filetype = ?,
+			size = ?,
+			completed_at = ?
+			WHERE id = ?
+		`),
+			nullableString(info.MetaData["filename"]),
+			nullableString(info.MetaData["filetype"]),
+			size,
+			completedAt,
+			row.ID,
+		)
+		if err != nil {
+			return filled, err
+		}
+		filled++
+	}
+
+	return filled, tx.Commit()
+}
+
+// postgresTypes replaces the column types used by the migrations, which SQLite
+// and MySQL both accept, with their Postgres equivalents
+var postgresTypes = strings.NewReplacer(
+	"INTEGER(8)", "BIGINT",
+	"INTEGER(1)", "SMALLINT",
+	"BLOB", "BYTEA",
+)
+
+// createIndex and dropIndex match the index statements of the migrations
+var (
+	createIndex = regexp.MustCompile(`^CREATE INDEX (\w+) ON (\w+)`)
+	dropIndex   = regexp.MustCompile(`^DROP INDEX (\w+);$`)
+)
+
+// forDialect adapts the migrations to the SQL dialect of a database driver
+func forDialect(driverName string, source *migrate.MemoryMigrationSource) *migrate.MemoryMigrationSource {
+	if driverName == "mysql" {
+		return mysqlDialect(source)
+	}
+	if driverName != "postgres" {
+		return source
+	}
+
+	for _, migration := range source.Migrations {
+		up := make([]string, 0, len(migration.Up))
+		for _, statement := range migration.Up {
+			up = append(up, postgresTypes.Replace(statement))
+
+			// Postgres keeps the name of the primary key index when renaming
+			// a table, which would clash with the next table rebuild
+			if strings.Contains(statement, "ALTER TABLE new_uploads RENAME TO uploads") {
+				up = append(up, "ALTER INDEX new_uploads_pkey RENAME TO uploads_pkey;")
+			}
+		}
+		migration.Up = up
+	}
+	return source
+}
+
+// mysqlDialect names the table of the indexes dropped by migrations, which
+// MySQL requires
+func mysqlDialect(source *migrate.MemoryMigrationSource) *migrate.MemoryMigrationSource {
+	indexTables := make(map[string]string)
+	for _, migration := range source.Migrations {
+		for _, statement := range migration.Up {
+			if match := createIndex.FindStringSubmatch(statement); match != nil {
+				indexTables[match[1]] = match[2]
+			}
+		}
+	}
+
+	for _, migration := range source.Migrations {
+		for i, statement := range migration.Down {
+			if match := dropIndex.FindStringSubmatch(statement); match != nil {
+				migration.Down[i] = fmt.Sprintf("DROP INDEX %s ON %s;", match[1], indexTables[match[1]])
+			}
+		}
 	}
+	return source
 }
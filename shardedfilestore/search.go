@@ -0,0 +1,206 @@
+package shardedfilestore
+
+import (
+	"encoding/hex"
+	"net"
+	"strings"
+
+	"github.com/tus/tusd/pkg/handler"
+)
+
+// UploadRecord is the stored state of an upload, as shown to admins
+type UploadRecord struct {
+	ID             string  `db:"id" json:"id"`
+	UploaderIP     string  `db:"uploader_ip" json:"uploader_ip"`
+	JwtAccount     string  `db:"jwt_account" json:"jwt_account"`
+	JwtIssuer      string  `db:"jwt_issuer" json:"jwt_issuer"`
+	SHA256Sum      []byte  `db:"sha256sum" json:"-"`
+	SHA256         string  `db:"-" json:"sha256,omitempty"`
+	PHash          *string `db:"phash" json:"phash,omitempty"`
+	CreatedAt      int64   `db:"created_at" json:"created_at"`
+	ExpiresAt      *int64  `db:"expires_at" json:"expires_at,omitempty"`
+	Deleted        bool    `db:"deleted" json:"deleted"`
+	DeletedAt      *int64  `db:"deleted_at" json:"deleted_at,omitempty"`
+	Purged         bool    `db:"purged" json:"purged"`
+	Quarantined    bool    `db:"quarantined" json:"quarantined"`
+	Private        bool    `db:"private" json:"private"`
+	HasPassword    bool    `db:"has_password" json:"has_password"`
+	MaxDownloads   int64   `db:"max_downloads" json:"max_downloads"`
+	DownloadCount  int64   `db:"download_count" json:"download_count"`
+	BytesServed    int64   `db:"bytes_served" json:"bytes_served"`
+	LastAccessedAt *int64  `db:"last_accessed_at" json:"last_accessed_at,omitempty"`
+	Filename       string  `db:"filename" json:"filename,omitempty"`
+	Filetype       string  `db:"filetype" json:"filetype,omitempty"`
+	Size           int64   `db:"size" json:"size,omitempty"`
+	CompletedAt    *int64  `db:"completed_at" json:"completed_at,omitempty"`
+}
+
+// UploadFilter selects the uploads returned by SearchUploads. Empty fields
+// match every upload.
+type UploadFilter struct {
+	ID             string
+	IPNet          *net.IPNet // Uploader IP address or range
+	Account        string
+	Issuer         string
+	SHA256         []byte
+	Filetype       string // Pattern that can include wildcards * and/or ?
+	MinSize        int64
+	CreatedAfter   int64
+	CreatedBefore  int64
+	IncludeDeleted bool
+	LargestFirst   bool // Order by size instead of newest first
+	Limit          int
+	Offset         int
+}
+
+const uploadRecordColumns = `
+	id,
+	COALESCE(uploader_ip, '') AS uploader_ip,
+	jwt_account,
+	jwt_issuer,
+	sha256sum,
+	phash,
+	created_at,
+	expires_at,
+	deleted,
+	deleted_at,
+	purged,
+	quarantined,
+	private,
+	password_hash IS NOT NULL AS has_password,
+	max_downloads,
+	download_count,
+	bytes_served,
+	last_accessed_at,
+	COALESCE(filename, '') AS filename,
+	COALESCE(filetype, '') AS filetype,
+	COALESCE(size, 0) AS size,
+	completed_at
+`
+
+// likeEscaper escapes the characters of a LIKE pattern, with ! as the escape
+// character since MySQL treats backslashes in literals as escapes
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// wildcardToLike converts a pattern with wildcards * and ? to a LIKE pattern
+func wildcardToLike(pattern string) string {
+	pattern = likeEscaper.Replace(pattern)
+	return strings.NewReplacer("*", "%", "?", "_").Replace(pattern)
+}
+
+// SearchUploads returns the uploads matching filter, newest first
+func (store *ShardedFileStore) SearchUploads(filter UploadFilter) ([]UploadRecord, error) {
+	var conditions []string
+	var args []interface{}
+
+	if filter.ID != "" {
+		conditions = append(conditions, "id = ?")
+		args = append(args, filter.ID)
+	}
+	// single addresses can be matched by the database, ranges are matched
+	// as the rows are read
+	ipRange := filter.IPNet
+	if ipRange != nil {
+		if ones, bits := ipRange.Mask.Size(); ones == bits {
+			conditions = append(conditions, "uploader_ip = ?")
+			args = append(args, ipRange.IP.String())
+			ipRange = nil
+		}
+	}
+	if filter.Account != "" {
+		conditions = append(conditions, "jwt_account = ?")
+		args = append(args, filter.Account)
+	}
+	if filter.Issuer != "" {
+		conditions = append(conditions, "jwt_issuer = ?")
+		args = append(args, filter.Issuer)
+	}
+	if filter.SHA256 != nil {
+		conditions = append(conditions, "sha256sum = ?")
+		args = append(args, filter.SHA256)
+	}
+	if filter.Filetype != "" {
+		conditions = append(conditions, "filetype LIKE ? ESCAPE '!'")
+		args = append(args, wildcardToLike(filter.Filetype))
+	}
+	if filter.MinSize > 0 {
+		conditions = append(conditions, "size >= ?")
+		args = append(args, filter.MinSize)
+	}
+	if filter.CreatedAfter > 0 {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, filter.CreatedAfter)
+	}
+	if filter.CreatedBefore > 0 {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, filter.CreatedBefore)
+	}
+	if !filter.IncludeDeleted {
+		conditions = append(conditions, "deleted = 0")
+	}
+
+	query := "SELECT " + uploadRecordColumns + " FROM uploads"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	if filter.LargestFirst {
+		query += " ORDER BY size DESC, created_at DESC"
+	} else {
+		query += " ORDER BY created_at DESC"
+	}
+
+	// the database pages the results unless rows are filtered as they are read
+	offset := filter.Offset
+	if ipRange == nil && filter.Limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, filter.Limit, filter.Offset)
+		offset = 0
+	}
+
+	rows, err := store.DBConn.DB.Queryx(store.DBConn.DB.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]UploadRecord, 0)
+	skipped := 0
+	for rows.Next() {
+		if filter.Limit > 0 && len(records) >= filter.Limit {
+			break
+		}
+
+		var record UploadRecord
+		if err := rows.StructScan(&record); err != nil {
+			return nil, err
+		}
+
+		if ipRange != nil && !ipRange.Contains(net.ParseIP(record.UploaderIP)) {
+			continue
+		}
+
+		if record.SHA256Sum != nil {
+			record.SHA256 = hex.EncodeToString(record.SHA256Sum)
+		}
+
+		if skipped < offset {
+			skipped++
+			continue
+		}
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
+// GetUploadRecord returns the stored state of an upload, including deleted ones
+func (store *ShardedFileStore) GetUploadRecord(id string) (*UploadRecord, error) {
+	records, err := store.SearchUploads(UploadFilter{ID: id, IncludeDeleted: true, Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, handler.ErrNotFound
+	}
+	return &records[0], nil
+}
@@ -13,8 +13,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"image"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -23,46 +25,95 @@ import (
 	"time"
 
 	"github.com/IGLOU-EU/go-wildcard"
+	"github.com/jmoiron/sqlx"
 	"github.com/rs/zerolog"
 	"github.com/tus/tusd/pkg/handler"
 
 	_ "github.com/go-sql-driver/mysql" // register mysql driver
+	_ "github.com/lib/pq"              // register postgres driver
 	_ "github.com/mattn/go-sqlite3"    // register SQL driver
 
+	"github.com/kiwiirc/plugin-fileuploader/blocklist"
+	"github.com/kiwiirc/plugin-fileuploader/clamav"
 	"github.com/kiwiirc/plugin-fileuploader/config"
 	"github.com/kiwiirc/plugin-fileuploader/db"
+	"github.com/kiwiirc/plugin-fileuploader/icap"
+	"github.com/kiwiirc/plugin-fileuploader/imagehash"
+	"github.com/kiwiirc/plugin-fileuploader/metrics"
 )
 
 var defaultFilePerm = os.FileMode(0664)
 var defaultDirectoryPerm = os.FileMode(0775)
 
+// ErrUploadGone is returned for uploads that have been terminated
+var ErrUploadGone = handler.NewHTTPError(errors.New("upload has been deleted"), http.StatusGone)
+
+// ErrUploadQuarantined is returned for uploads that are held for review
+var ErrUploadQuarantined = handler.NewHTTPError(errors.New("upload has been quarantined"), http.StatusUnavailableForLegalReasons)
+
+// ErrNotTrashed is returned when restoring an upload that has not been terminated
+var ErrNotTrashed = errors.New("upload is not in the trash")
+
+// ErrPurged is returned when restoring an upload whose files have already been removed
+var ErrPurged = errors.New("upload has already been purged")
+
+// ErrUnfinished is returned when restoring an upload that was terminated before it finished
+var ErrUnfinished = errors.New("upload was never finished")
+
 // ShardedFileStore implements various tusd.DataStore-related interfaces.
 // See the interfaces for more documentation about the different methods.
 type ShardedFileStore struct {
 	BasePath             string        // Relative or absolute path to store files in.
-	PrefixShardLayers    int           // Number of extra directory layers to prefix file paths with.
+	Layout               Layout        // How files are spread over directories
 	ExpireTime           time.Duration // How long before an upload expires (seconds)
 	ExpireIdentifiedTime time.Duration // How long before an upload expires with valid account (seconds)
+	TrashRetention       time.Duration // How long terminated uploads are kept before being purged
+	SlidingStep          time.Duration // How far each download pushes the expiry of identified uploads
+	SlidingMaxAge        time.Duration // Latest expiry of identified uploads, from their creation
 	PreFinishCommands    []config.PreFinishCommand
+	Blocklist            *blocklist.Blocklist           // Hashes of files that are rejected
+	BlocklistStatus      int                            // HTTP status returned when rejecting blocked files
+	HashImages           bool                           // Whether to compute perceptual hashes of images
+	PerceptualBlocklist  *blocklist.PerceptualBlocklist // Perceptual hashes of images that are matched
+	PerceptualThreshold  int                            // Largest Hamming distance counted as a match
+	PerceptualAction     string                         // "reject", "quarantine" or "log" on a match
+	ClamAV               *clamav.Client                 // Virus scanner, nil when disabled
+	ClamAVAction         string                         // "reject" or "quarantine" for infected files
+	ClamAVFailOpen       bool                           // Accept files that could not be scanned
+	ClamAVAcceptOversize bool                           // Accept files larger than clamd scans
+	ICAP                 *icap.Client                   // Content inspection service, nil when disabled
+	ICAPHeaders          map[string]string              // ICAP headers set from metadata keys
+	ICAPFailOpen         bool                           // Accept files that could not be inspected
+	MetadataInDatabase   bool                           // Keep upload info in the upload_info table instead of .info files
 	DBConn               *db.DatabaseConnection
 	log                  *zerolog.Logger
+	downloadStats        *downloadStats
 }
 
+// DerivedMetadata are the metadata keys filled from the database when an upload
+// is loaded, which are not stored in its .info file
+var DerivedMetadata = []string{"downloads", "bytes-served", "last-accessed"}
+
 // New creates a new file based storage backend. The directory specified will
 // be used as the only storage entry. This method does not check
 // whether the path exists, use os.MkdirAll to ensure.
 // In addition, a locking mechanism is provided.
-func New(basePath string, prefixShardLayers int, expireTime, expireIdentifiedTime time.Duration, PreFinishCommands []config.PreFinishCommand, dbConnection *db.DatabaseConnection, log *zerolog.Logger) *ShardedFileStore {
+// The database schema must be checked with CheckSchema before the store is used.
+func New(basePath string, layout Layout, expireTime, expireIdentifiedTime, trashRetention, slidingStep, slidingMaxAge, statsFlushInterval time.Duration, PreFinishCommands []config.PreFinishCommand, dbConnection *db.DatabaseConnection, log *zerolog.Logger) *ShardedFileStore {
 	store := &ShardedFileStore{
 		BasePath:             basePath,
-		PrefixShardLayers:    prefixShardLayers,
+		Layout:               layout,
 		ExpireTime:           expireTime,
 		ExpireIdentifiedTime: expireIdentifiedTime,
+		TrashRetention:       trashRetention,
+		SlidingStep:          slidingStep,
+		SlidingMaxAge:        slidingMaxAge,
 		PreFinishCommands:    PreFinishCommands,
 		DBConn:               dbConnection,
 		log:                  log,
+		downloadStats:        newDownloadStats(),
 	}
-	store.initDB()
+	go store.flushLoop(statsFlushInterval)
 	return store
 }
 
@@ -88,23 +139,39 @@ func (store ShardedFileStore) NewUpload(ctx context.Context, info handler.FileIn
 	}
 
 	// Create the directory stucture if needed
-	err = os.MkdirAll(store.metaDir(info.ID), defaultDirectoryPerm)
-	if err != nil {
-		return nil, err
+	if !store.MetadataInDatabase {
+		err = os.MkdirAll(store.metaDir(info.ID), defaultDirectoryPerm)
+		if err != nil {
+			return nil, err
+		}
 	}
 	err = os.MkdirAll(store.incompleteBinDir(), defaultDirectoryPerm)
 	if err != nil {
 		return nil, err
 	}
 
-	// Metadata is exposed to users via headers, so remove RemoteIP
+	// Metadata is exposed to users via headers, so remove RemoteIP and secrets
 	remoteIP := info.MetaData["RemoteIP"]
 	delete(info.MetaData, "RemoteIP")
+	deletionTokenHash := nullableMetadata(info.MetaData, "DeletionTokenHash")
+	passwordHash := nullableMetadata(info.MetaData, "PasswordHash")
+
+	// max-downloads and private have been validated by the server, missing
+	// values mean unlimited and public
+	maxDownloads, _ := strconv.Atoi(info.MetaData["max-downloads"])
+	private, _ := strconv.ParseBool(info.MetaData["private"])
+
+	// the size is not known yet when the client defers its length
+	var size sql.NullInt64
+	if !info.SizeIsDeferred {
+		size = sql.NullInt64{Int64: info.Size, Valid: true}
+	}
 
 	// create record in uploads table
 	err = db.UpdateRow(store.DBConn.DB,
-		`INSERT INTO uploads(id, created_at, uploader_ip, jwt_account, jwt_issuer) VALUES (?, ?, ?, ?, ?)`,
-		info.ID, time.Now().Unix(), remoteIP, info.MetaData["account"], info.MetaData["issuer"],
+		`INSERT INTO uploads(id, created_at, uploader_ip, jwt_account, jwt_issuer, deletion_token_hash, max_downloads, password_hash, private, filename, filetype, size) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		info.ID, time.Now().Unix(), remoteIP, info.MetaData["account"], info.MetaData["issuer"], deletionTokenHash, maxDownloads, passwordHash, db.Bool(private),
+		nullableString(info.MetaData["filename"]), nullableString(info.MetaData["filetype"]), size,
 	)
 	if err != nil {
 		return nil, err
@@ -138,16 +205,19 @@ func (store ShardedFileStore) NewUpload(ctx context.Context, info handler.FileIn
 }
 
 func (store ShardedFileStore) GetUpload(ctx context.Context, id string) (handler.Upload, error) {
-	info := handler.FileInfo{}
-	data, err := ioutil.ReadFile(store.infoPath(id))
+	state, err := store.lookupState(id)
 	if err != nil {
-		if os.IsNotExist(err) {
-			// Interpret os.ErrNotExist as 404 Not Found
-			err = handler.ErrNotFound
-		}
 		return nil, err
 	}
-	if err := json.Unmarshal(data, &info); err != nil {
+	if state.Deleted {
+		return nil, ErrUploadGone
+	}
+	if state.Quarantined {
+		return nil, ErrUploadQuarantined
+	}
+
+	info, err := store.readInfo(id)
+	if err != nil {
 		return nil, err
 	}
 
@@ -164,6 +234,29 @@ func (store ShardedFileStore) GetUpload(ctx context.Context, id string) (handler
 
 	info.Offset = stat.Size()
 
+	if state.Finished {
+		if info.MetaData == nil {
+			info.MetaData = make(handler.MetaData)
+		}
+
+		// the expiry may have been extended by downloads
+		if state.ExpiresAt.Valid {
+			info.MetaData["expires"] = strconv.FormatInt(state.ExpiresAt.Int64, 10)
+		}
+
+		// include download statistics that have not been flushed yet
+		pending := store.downloadStats.get(id)
+		info.MetaData["downloads"] = strconv.FormatInt(state.DownloadCount+pending.count, 10)
+		info.MetaData["bytes-served"] = strconv.FormatInt(state.BytesServed+pending.bytes, 10)
+		lastAccessed := state.LastAccessedAt.Int64
+		if pending.lastAccessed > lastAccessed {
+			lastAccessed = pending.lastAccessed
+		}
+		if lastAccessed > 0 {
+			info.MetaData["last-accessed"] = strconv.FormatInt(lastAccessed, 10)
+		}
+	}
+
 	return &fileUpload{
 		info:     info,
 		binPath:  binPath,
@@ -172,6 +265,33 @@ func (store ShardedFileStore) GetUpload(ctx context.Context, id string) (handler
 	}, nil
 }
 
+// readInfo reads the info of an upload, from the database or its .info file
+func (store ShardedFileStore) readInfo(id string) (info handler.FileInfo, err error) {
+	if store.MetadataInDatabase {
+		info, err = store.readInfoRow(id)
+		if err == handler.ErrNotFound {
+			// uploads made before the switch may not have been imported yet
+			return store.importInfoFile(id)
+		}
+		return info, err
+	}
+	return store.readInfoFile(id)
+}
+
+// readInfoFile reads the .info file of an upload
+func (store ShardedFileStore) readInfoFile(id string) (info handler.FileInfo, err error) {
+	data, err := ioutil.ReadFile(store.infoPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Interpret os.ErrNotExist as 404 Not Found
+			err = handler.ErrNotFound
+		}
+		return info, err
+	}
+	err = json.Unmarshal(data, &info)
+	return info, err
+}
+
 func (store ShardedFileStore) AsTerminatableUpload(upload handler.Upload) handler.TerminatableUpload {
 	return upload.(*fileUpload)
 }
@@ -266,15 +386,37 @@ func (upload *fileUpload) ConcatUploads(ctx context.Context, uploads []handler.U
 func (upload *fileUpload) DeclareLength(ctx context.Context, length int64) error {
 	upload.info.Size = length
 	upload.info.SizeIsDeferred = false
+
+	err := db.UpdateRow(upload.store.DBConn.DB, `
+		UPDATE uploads
+		SET size = ?
+		WHERE id = ?
+	`, length, upload.info.ID)
+	if err != nil {
+		return err
+	}
+
 	return upload.writeInfo()
 }
 
 // writeInfo updates the entire information. Everything will be overwritten.
 func (upload *fileUpload) writeInfo() error {
-	data, err := json.Marshal(upload.info)
+	info := upload.info
+	info.MetaData = make(handler.MetaData, len(upload.info.MetaData))
+	for key, value := range upload.info.MetaData {
+		info.MetaData[key] = value
+	}
+	for _, key := range DerivedMetadata {
+		delete(info.MetaData, key)
+	}
+
+	data, err := json.Marshal(info)
 	if err != nil {
 		return err
 	}
+	if upload.store.MetadataInDatabase {
+		return writeInfoRow(upload.store.DBConn, info.ID, data)
+	}
 	return ioutil.WriteFile(upload.infoPath, data, defaultFilePerm)
 }
 
@@ -326,11 +468,21 @@ func (upload *fileUpload) FinishUpload(ctx context.Context) error {
 				Str("stderr", stdErr.String()).
 				Msg("Error with pre-finish command")
 
-			upload.store.Terminate(upload.info.ID)
+			upload.reject("pre_finish_command")
 			return handler.NewHTTPError(errors.New("Upload has been reject by server"), 406)
 		}
 	}
 
+	err = upload.inspectContent(oldPath)
+	if err != nil {
+		return err
+	}
+
+	quarantined, err := upload.scanForViruses(oldPath)
+	if err != nil {
+		return err
+	}
+
 	// calculate hash
 	hash, err := upload.store.hashFile(upload.info.ID)
 	if err != nil {
@@ -340,6 +492,27 @@ func (upload *fileUpload) FinishUpload(ctx context.Context) error {
 		return err
 	}
 
+	if reason, blocked := upload.store.Blocklist.MatchSHA256(hash); blocked {
+		upload.store.log.Warn().
+			Str("event", "blocklist_match").
+			Str("action", "rejected").
+			Str("id", upload.info.ID).
+			Hex("sha256", hash).
+			Str("reason", reason).
+			Str("account", upload.info.MetaData["account"]).
+			Str("issuer", upload.info.MetaData["issuer"]).
+			Msg("Rejected upload matching blocklist")
+
+		upload.reject("blocklist")
+		return handler.NewHTTPError(errors.New("Upload has been rejected by server"), upload.store.BlocklistStatus)
+	}
+
+	phash, phashQuarantined, err := upload.checkPerceptualHash(oldPath)
+	if err != nil {
+		return err
+	}
+	quarantined = quarantined || phashQuarantined
+
 	expires := durationToExpire(upload.store.ExpireTime)
 	if upload.info.MetaData["account"] != "" {
 		expires = durationToExpire(upload.store.ExpireIdentifiedTime)
@@ -350,9 +523,13 @@ func (upload *fileUpload) FinishUpload(ctx context.Context) error {
 	err = db.UpdateRow(upload.store.DBConn.DB, `
 		UPDATE uploads
 		SET sha256sum = ?,
-		expires_at = ?
+		expires_at = ?,
+		phash = ?,
+		quarantined = ?,
+		size = ?,
+		completed_at = ?
 		WHERE id = ?
-	`, hash, expires, upload.info.ID)
+	`, hash, expires, phash, db.Bool(quarantined), upload.info.Size, time.Now().Unix(), upload.info.ID)
 	if err != nil {
 		upload.store.log.Error().
 			Err(err).
@@ -391,6 +568,210 @@ func (upload *fileUpload) FinishUpload(ctx context.Context) error {
 	return err
 }
 
+// reject purges an upload refused while finishing it, counting why. Rejected
+// uploads skip the trash, as tusd would still serve their unfinished files.
+func (upload *fileUpload) reject(reason string) {
+	metrics.UploadsRejected.With(metrics.RejectionLabels(upload.info.MetaData, reason)).Inc()
+	if err := upload.store.Purge(upload.info.ID); err != nil {
+		upload.store.log.Error().
+			Err(err).
+			Str("id", upload.info.ID).
+			Msg("Failed to purge rejected upload")
+	}
+}
+
+// inspectContent sends an upload to the ICAP service, rejecting blocked
+// uploads and replacing the content of modified ones
+func (upload *fileUpload) inspectContent(path string) error {
+	if upload.store.ICAP == nil {
+		return nil
+	}
+
+	request := icap.Request{
+		Filename:    upload.info.MetaData["filename"],
+		ContentType: upload.info.MetaData["filetype"],
+		Headers:     make(http.Header),
+	}
+	for header, key := range upload.store.ICAPHeaders {
+		if value := upload.info.MetaData[key]; value != "" {
+			request.Headers.Set(header, value)
+		}
+	}
+
+	// modified content is written next to the upload, then moved over it
+	modifiedPath := path + ".icap"
+	modified, err := os.OpenFile(modifiedPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, defaultFilePerm)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(modifiedPath)
+	defer modified.Close()
+
+	result, err := upload.store.ICAP.ScanFile(path, request, modified)
+	if err != nil {
+		upload.store.log.Error().
+			Err(err).
+			Str("event", "icap_failed").
+			Str("id", upload.info.ID).
+			Bool("fail_open", upload.store.ICAPFailOpen).
+			Msg("Failed to inspect upload")
+
+		if upload.store.ICAPFailOpen {
+			return nil
+		}
+		upload.reject("icap_failed")
+		return handler.NewHTTPError(errors.New("Upload could not be inspected"), http.StatusServiceUnavailable)
+	}
+
+	switch result.Verdict {
+	case icap.Blocked:
+		upload.store.log.Warn().
+			Str("event", "icap_blocked").
+			Str("id", upload.info.ID).
+			Str("reason", result.Reason).
+			Str("account", upload.info.MetaData["account"]).
+			Str("issuer", upload.info.MetaData["issuer"]).
+			Msg("Upload blocked by content inspection")
+
+		upload.reject("icap_blocked")
+		return handler.NewHTTPError(errors.New("Upload has been rejected by server"), http.StatusNotAcceptable)
+
+	case icap.Modified:
+		if err := modified.Close(); err != nil {
+			return err
+		}
+		if err := os.Rename(modifiedPath, path); err != nil {
+			return err
+		}
+		stat, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		upload.store.log.Info().
+			Str("event", "icap_modified").
+			Str("id", upload.info.ID).
+			Int64("old_size", upload.info.Size).
+			Int64("new_size", stat.Size()).
+			Msg("Upload content modified by content inspection")
+
+		upload.info.Size = stat.Size()
+		upload.info.Offset = stat.Size()
+	}
+
+	return nil
+}
+
+// scanForViruses scans an upload with clamd, rejecting infected uploads or
+// marking them to be quarantined
+func (upload *fileUpload) scanForViruses(path string) (quarantined bool, err error) {
+	if upload.store.ClamAV == nil {
+		return false, nil
+	}
+
+	start := time.Now()
+	result, err := upload.store.ClamAV.ScanFile(path)
+	if err == clamav.ErrSizeLimit {
+		upload.store.log.Warn().
+			Str("event", "virus_scan_too_large").
+			Str("id", upload.info.ID).
+			Int64("size", upload.info.Size).
+			Bool("accepted", upload.store.ClamAVAcceptOversize).
+			Msg("Upload is larger than clamd scans")
+
+		if upload.store.ClamAVAcceptOversize {
+			return false, nil
+		}
+		upload.reject("scan_too_large")
+		return false, handler.NewHTTPError(errors.New("Upload is too large to be scanned for viruses"), http.StatusRequestEntityTooLarge)
+	}
+	if err != nil {
+		upload.store.log.Error().
+			Err(err).
+			Str("event", "virus_scan_failed").
+			Str("id", upload.info.ID).
+			Bool("fail_open", upload.store.ClamAVFailOpen).
+			Msg("Failed to scan upload for viruses")
+
+		if upload.store.ClamAVFailOpen {
+			return false, nil
+		}
+		upload.reject("scan_failed")
+		return false, handler.NewHTTPError(errors.New("Upload could not be scanned for viruses"), http.StatusServiceUnavailable)
+	}
+
+	if !result.Infected {
+		upload.store.log.Debug().
+			Str("event", "virus_scan_clean").
+			Str("id", upload.info.ID).
+			Dur("duration", time.Since(start)).
+			Msg("Upload scanned for viruses")
+		return false, nil
+	}
+
+	upload.store.log.Warn().
+		Str("event", "virus_found").
+		Str("action", upload.store.ClamAVAction).
+		Str("id", upload.info.ID).
+		Str("signature", result.Signature).
+		Str("account", upload.info.MetaData["account"]).
+		Str("issuer", upload.info.MetaData["issuer"]).
+		Msg("Virus found in upload")
+
+	if upload.store.ClamAVAction == "quarantine" {
+		return true, nil
+	}
+	upload.reject("virus")
+	return false, handler.NewHTTPError(fmt.Errorf("Upload has been rejected by server: virus detected (%s)", result.Signature), http.StatusNotAcceptable)
+}
+
+// checkPerceptualHash computes the perceptual hash of an image upload and
+// matches it against the perceptual blocklist. The hash is null for uploads
+// that are not images.
+func (upload *fileUpload) checkPerceptualHash(path string) (phash sql.NullString, quarantined bool, err error) {
+	if !upload.store.HashImages {
+		return
+	}
+
+	imageHash, err := imagehash.DHashFile(path)
+	if err != nil {
+		if err != image.ErrFormat {
+			upload.store.log.Warn().
+				Err(err).
+				Str("id", upload.info.ID).
+				Msg("Failed to compute perceptual hash")
+		}
+		return phash, false, nil
+	}
+	phash = sql.NullString{String: imagehash.Format(imageHash), Valid: true}
+
+	reason, distance, blocked := upload.store.PerceptualBlocklist.Match(imageHash, upload.store.PerceptualThreshold)
+	if !blocked {
+		return
+	}
+
+	upload.store.log.Warn().
+		Str("event", "phash_match").
+		Str("action", upload.store.PerceptualAction).
+		Str("id", upload.info.ID).
+		Str("phash", phash.String).
+		Int("distance", distance).
+		Str("reason", reason).
+		Str("account", upload.info.MetaData["account"]).
+		Str("issuer", upload.info.MetaData["issuer"]).
+		Msg("Upload matches perceptual blocklist")
+
+	switch upload.store.PerceptualAction {
+	case "log":
+	case "quarantine":
+		quarantined = true
+	default:
+		upload.reject("perceptual_blocklist")
+		err = handler.NewHTTPError(errors.New("Upload has been rejected by server"), upload.store.BlocklistStatus)
+	}
+	return
+}
+
 // ADDED FUNCTIONS
 
 // taken from https://github.com/tus/tusd/blob/42bfe35457f8bfc79a0af40a9f51c8112903737e/internal/uid/uid.go
@@ -405,7 +786,34 @@ func Uid() string {
 	return hex.EncodeToString(id)
 }
 
+// Terminate moves an upload to the trash. Its files are kept until the
+// TrashRetention period has passed, or removed straight away when it is zero.
 func (store *ShardedFileStore) Terminate(id string) error {
+	if store.TrashRetention <= 0 {
+		return store.Purge(id)
+	}
+
+	err := db.UpdateRow(store.DBConn.DB, `
+		UPDATE uploads
+		SET deleted = 1,
+		deleted_at = ?
+		WHERE id = ?
+	`, time.Now().Unix(), id)
+	if err != nil {
+		return err
+	}
+
+	store.log.Info().
+		Str("event", "trashed").
+		Str("id", id).
+		Msg("Moved upload to trash")
+
+	return nil
+}
+
+// Purge permanently removes an upload's files. The blob is only removed when
+// no other unpurged upload shares it.
+func (store *ShardedFileStore) Purge(id string) error {
 	duplicates, err := store.getDuplicateCount(id)
 	if err != nil {
 		return err
@@ -424,26 +832,355 @@ func (store *ShardedFileStore) Terminate(id string) error {
 			Msg("Removed upload bin")
 	}
 
-	// remove upload .info file
-	if err := RemoveWithDirs(store.infoPath(id), store.BasePath); err != nil {
+	// remove upload info
+	if err := store.removeInfo(id); err != nil {
+		return err
+	}
+
+	// mark upload db record as deleted and purged
+	err = db.UpdateRow(store.DBConn.DB, `
+		UPDATE uploads
+		SET deleted = 1,
+		purged = 1,
+		deleted_at = COALESCE(deleted_at, ?)
+		WHERE id = ?
+	`, time.Now().Unix(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Quarantine holds an upload for review. Downloads of quarantined uploads are
+// refused and they don't expire, but their files are kept.
+func (store *ShardedFileStore) Quarantine(id string) error {
+	return store.setQuarantined(id, true)
+}
+
+// Unquarantine releases an upload held by Quarantine. Released uploads are not
+// quarantined again by later abuse reports.
+func (store *ShardedFileStore) Unquarantine(id string) error {
+	return store.setQuarantined(id, false)
+}
+
+func (store *ShardedFileStore) setQuarantined(id string, quarantined bool) error {
+	state, err := store.lookupState(id)
+	if err != nil {
+		return err
+	}
+	if !state.Finished {
+		return handler.ErrNotFound
+	}
+	if state.Deleted {
+		return ErrUploadGone
+	}
+
+	// releasing an upload is remembered, so that reports don't quarantine it again
+	set := "quarantined = 1"
+	if !quarantined {
+		set = "quarantined = 0, quarantine_released = 1"
+	}
+	_, err = store.DBConn.DB.Exec(store.DBConn.DB.Rebind(`
+		UPDATE uploads
+		SET `+set+`
+		WHERE id = ?
+	`), id)
+	if err != nil {
+		return err
+	}
+
+	event := "quarantined"
+	if !quarantined {
+		event = "unquarantined"
+	}
+	store.log.Info().
+		Str("event", event).
+		Str("id", id).
+		Msg("Changed quarantine state of upload")
+	return nil
+}
+
+// SetExpiry changes when an upload expires
+func (store *ShardedFileStore) SetExpiry(id string, expiresAt int64) error {
+	state, err := store.lookupState(id)
+	if err != nil {
+		return err
+	}
+	if !state.Finished {
+		return handler.ErrNotFound
+	}
+	if state.Deleted {
+		return ErrUploadGone
+	}
+
+	_, err = store.DBConn.DB.Exec(store.DBConn.DB.Rebind(`
+		UPDATE uploads
+		SET expires_at = ?
+		WHERE id = ?
+	`), expiresAt, id)
+	if err != nil {
 		return err
 	}
 
-	// mark upload db record as deleted
+	store.log.Info().
+		Str("event", "expiry_changed").
+		Str("id", id).
+		Int64("expires", expiresAt).
+		Msg("Changed expiry of upload")
+	return nil
+}
+
+// Restore brings a trashed upload back with its original id and metadata.
+// Uploads that expired while in the trash are given a fresh expiry time.
+func (store *ShardedFileStore) Restore(id string) error {
+	var deleted, purged, finished bool
+	var expiresAt sql.NullInt64
+	var jwtAccount string
+	err := store.DBConn.DB.QueryRow(store.DBConn.DB.Rebind(`
+		SELECT deleted, purged, completed_at IS NOT NULL AS finished, expires_at, jwt_account
+		FROM uploads
+		WHERE id = ?
+	`), id).Scan(&deleted, &purged, &finished, &expiresAt, &jwtAccount)
+	if err == sql.ErrNoRows {
+		return handler.ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if purged {
+		return ErrPurged
+	}
+	if !deleted {
+		return ErrNotTrashed
+	}
+	// tusd serves unfinished uploads as they are, including rejected ones
+	if !finished {
+		return ErrUnfinished
+	}
+
+	if expiresAt.Valid && expiresAt.Int64 <= time.Now().Unix() {
+		expiresAt.Int64 = durationToExpire(store.ExpireTime)
+		if jwtAccount != "" {
+			expiresAt.Int64 = durationToExpire(store.ExpireIdentifiedTime)
+		}
+	}
+
 	err = db.UpdateRow(store.DBConn.DB, `
 		UPDATE uploads
-		SET deleted = 1
+		SET deleted = 0,
+		deleted_at = NULL,
+		expires_at = ?
 		WHERE id = ?
-	`, id)
+	`, expiresAt, id)
 	if err != nil {
 		return err
 	}
 
+	// keep the expiry exposed in the upload metadata in sync
+	if expiresAt.Valid {
+		upload, err := store.GetUpload(context.Background(), id)
+		if err != nil {
+			return err
+		}
+		fUpload := upload.(*fileUpload)
+		if _, ok := fUpload.info.MetaData["expires"]; ok {
+			fUpload.info.MetaData["expires"] = strconv.FormatInt(expiresAt.Int64, 10)
+			if err := fUpload.writeInfo(); err != nil {
+				return err
+			}
+		}
+	}
+
+	store.log.Info().
+		Str("event", "restored").
+		Str("id", id).
+		Msg("Restored upload from trash")
+
 	return nil
 }
 
+// ReserveDownload counts a download of an upload with a download limit
+// before it starts, so that concurrent downloads can't exceed the limit. It
+// returns false when the limit has been reached or the upload is gone. The
+// reservation is completed by CountDownload or undone by ReleaseDownload.
+func (store *ShardedFileStore) ReserveDownload(id string) (bool, error) {
+	res, err := store.DBConn.DB.Exec(store.DBConn.DB.Rebind(`
+		UPDATE uploads
+		SET download_count = download_count + 1
+		WHERE id = ? AND
+			deleted = 0 AND
+			sha256sum IS NOT NULL AND
+			max_downloads > 0 AND
+			download_count < max_downloads
+	`), id)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := res.RowsAffected()
+	return count == 1, err
+}
+
+// ReleaseDownload undoes the reservation of a download that wasn't completed
+func (store *ShardedFileStore) ReleaseDownload(id string) error {
+	_, err := store.DBConn.DB.Exec(store.DBConn.DB.Rebind(`
+		UPDATE uploads
+		SET download_count = download_count - 1
+		WHERE id = ? AND download_count > 0
+	`), id)
+	return err
+}
+
+// CountDownload records a completed download reserved with ReserveDownload,
+// and terminates the upload once the limit has been reached and no other
+// download of it is still running. Unlike RecordDownload it is written to the
+// database immediately.
+func (store *ShardedFileStore) CountDownload(id string, bytes int64) error {
+	tx, err := store.DBConn.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(tx.Rebind(`
+		UPDATE uploads
+		SET bytes_served = bytes_served + ?,
+		last_accessed_at = ?
+		WHERE id = ?
+	`), bytes, time.Now().Unix(), id)
+	if err != nil {
+		return err
+	}
+
+	var downloadCount, maxDownloads int
+	err = tx.QueryRow(tx.Rebind(`SELECT download_count, max_downloads FROM uploads WHERE id = ?`), id).
+		Scan(&downloadCount, &maxDownloads)
+	if err != nil {
+		return err
+	}
+
+	if store.SlidingStep > 0 {
+		err = store.slideExpiry(tx, id, time.Now().Unix())
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	store.log.Info().
+		Str("event", "downloaded").
+		Str("id", id).
+		Int64("bytes", bytes).
+		Int("downloads", downloadCount).
+		Int("maxDownloads", maxDownloads).
+		Msg("Upload downloaded")
+
+	// a reserved download that is still running may yet be released, it
+	// terminates the upload itself when it completes
+	if downloadCount < maxDownloads || store.IsDownloading(id) {
+		return nil
+	}
+
+	store.log.Info().
+		Str("event", "download_limit_reached").
+		Str("id", id).
+		Int("downloads", downloadCount).
+		Msg("Upload reached its download limit")
+
+	return store.Terminate(id)
+}
+
+// sweepBatchSize is how many blocklisted hashes SweepBlocklist looks up per
+// query, below the limit on query parameters of SQLite
+const sweepBatchSize = 500
+
+// SweepBlocklist terminates every existing upload matching the blocklist. It
+// returns early once stop is closed.
+func (store *ShardedFileStore) SweepBlocklist(stop <-chan struct{}) {
+	hashes := store.Blocklist.SHA256Hashes()
+	for start := 0; start < len(hashes); start += sweepBatchSize {
+		if isClosed(stop) {
+			return
+		}
+
+		end := start + sweepBatchSize
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+
+		var matches []struct {
+			ID         string `db:"id"`
+			SHA256Sum  []byte `db:"sha256sum"`
+			UploaderIP string `db:"uploader_ip"`
+			JwtAccount string `db:"jwt_account"`
+			JwtIssuer  string `db:"jwt_issuer"`
+		}
+		query, args, err := sqlx.In(`
+			SELECT id, sha256sum, uploader_ip, jwt_account, jwt_issuer
+			FROM uploads
+			WHERE sha256sum IN (?) AND deleted = 0
+		`, hashes[start:end])
+		if err == nil {
+			err = store.DBConn.DB.Select(&matches, store.DBConn.DB.Rebind(query), args...)
+		}
+		if err != nil {
+			store.log.Error().
+				Err(err).
+				Msg("Failed to look up uploads matching blocklist")
+			return
+		}
+
+		for _, match := range matches {
+			if isClosed(stop) {
+				return
+			}
+
+			reason, _ := store.Blocklist.MatchSHA256(match.SHA256Sum)
+			err := store.Terminate(match.ID)
+			if err != nil {
+				store.log.Error().
+					Err(err).
+					Str("id", match.ID).
+					Msg("Failed to terminate upload matching blocklist")
+				continue
+			}
+
+			store.log.Warn().
+				Str("event", "blocklist_match").
+				Str("action", "terminated").
+				Str("id", match.ID).
+				Hex("sha256", match.SHA256Sum).
+				Str("reason", reason).
+				Str("ip", match.UploaderIP).
+				Str("account", match.JwtAccount).
+				Str("issuer", match.JwtIssuer).
+				Msg("Terminated existing upload matching blocklist")
+		}
+	}
+}
+
+// isClosed reports whether a stop channel has been closed
+func isClosed(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
 func (store *ShardedFileStore) hashFile(id string) ([]byte, error) {
-	f, err := os.Open(store.binPath(id))
+	return hashPath(store.binPath(id))
+}
+
+// hashPath computes the SHA-256 hash of the file at path
+func hashPath(path string) ([]byte, error) {
+	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
@@ -478,15 +1215,16 @@ func (store *ShardedFileStore) getDuplicateCount(id string) (duplicates int, err
 		return
 	}
 
-	// check if there are any other uploads pointing to this file
-	err = store.DBConn.DB.QueryRow(`
+	// check if there are any other uploads pointing to this file, including
+	// trashed ones that could still be restored
+	err = store.DBConn.DB.QueryRow(store.DBConn.DB.Rebind(`
 		SELECT count(id)
 		FROM uploads
 		WHERE
 			sha256sum = ? AND
 			id != ? AND
-			deleted = 0
-	`, hash, id).Scan(&duplicates)
+			purged = 0
+	`), hash, id).Scan(&duplicates)
 
 	return
 }
@@ -517,6 +1255,17 @@ func RemoveWithDirs(path string, basePath string) (err error) {
 		return err
 	}
 
+	return removeEmptyParents(path, basePath)
+}
+
+// removeEmptyParents deletes the empty parent directories of path up to the
+// given basePath
+func removeEmptyParents(path string, basePath string) error {
+	absBase, err := filepath.Abs(basePath)
+	if err != nil {
+		return err
+	}
+
 	parent := path
 	for {
 		parent = filepath.Dir(parent)
@@ -543,7 +1292,7 @@ func RemoveWithDirs(path string, basePath string) (err error) {
 // lookupHash translates a randomly generated upload id into its cryptographic
 // hash by querying the upload database.
 func (store *ShardedFileStore) lookupHash(id string) (hash []byte, isFinal bool, err error) {
-	row := store.DBConn.DB.QueryRow(`SELECT sha256sum FROM uploads WHERE id = ?`, id)
+	row := store.DBConn.DB.QueryRow(store.DBConn.DB.Rebind(`SELECT sha256sum FROM uploads WHERE id = ?`), id)
 	err = row.Scan(&hash)
 
 	// no finalized upload exists
@@ -562,6 +1311,31 @@ func (store *ShardedFileStore) lookupHash(id string) (hash []byte, isFinal bool,
 	return
 }
 
+// uploadState holds the parts of an upload's state that are only kept in the database
+type uploadState struct {
+	Deleted        bool          `db:"deleted"`
+	Finished       bool          `db:"finished"`
+	Quarantined    bool          `db:"quarantined"`
+	ExpiresAt      sql.NullInt64 `db:"expires_at"`
+	DownloadCount  int64         `db:"download_count"`
+	BytesServed    int64         `db:"bytes_served"`
+	LastAccessedAt sql.NullInt64 `db:"last_accessed_at"`
+}
+
+// lookupState fetches the database state of an upload, which is empty for
+// uploads without a database record
+func (store *ShardedFileStore) lookupState(id string) (state uploadState, err error) {
+	err = store.DBConn.DB.Get(&state, store.DBConn.DB.Rebind(`
+		SELECT deleted, sha256sum IS NOT NULL AS finished, quarantined, expires_at, download_count, bytes_served, last_accessed_at
+		FROM uploads
+		WHERE id = ?
+	`), id)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
 // metaDir returns the directory that the info and lock files reside in for a given id
 func (store *ShardedFileStore) metaDir(id string) string {
 	// <base-path>/meta/<id-shards>
@@ -577,14 +1351,7 @@ func (store *ShardedFileStore) lockPath(id string) string {
 
 // generates a directory hierarchy
 func (store *ShardedFileStore) shards(id string) string {
-	if len(id) < store.PrefixShardLayers {
-		panic("id is too short for requested number of shard layers")
-	}
-	shards := make([]string, store.PrefixShardLayers)
-	for n, char := range id[:store.PrefixShardLayers] {
-		shards[n] = string(char)
-	}
-	return filepath.Join(shards...)
+	return store.Layout.shards(id)
 }
 
 func (store *ShardedFileStore) incompleteBinDir() string {
@@ -603,6 +1370,18 @@ func (store ShardedFileStore) completeBinPath(hashBytes []byte) string {
 	return filepath.Join(store.BasePath, "complete", shards, hash+".bin")
 }
 
+// nullableMetadata removes a metadata value, returning it as NULL if it was empty
+func nullableMetadata(metadata handler.MetaData, key string) sql.NullString {
+	value := metadata[key]
+	delete(metadata, key)
+	return nullableString(value)
+}
+
+// nullableString returns an empty string as NULL
+func nullableString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
+
 func durationToExpire(d time.Duration) int64 {
 	timeStr := fmt.Sprintf("%.0f", d.Seconds())
 	timeInt, _ := strconv.Atoi(timeStr)
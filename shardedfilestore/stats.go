@@ -0,0 +1,109 @@
+package shardedfilestore
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Stats summarises the uploads in a store
+type Stats struct {
+	Uploads     int64 `db:"uploads" json:"uploads"`           // Every upload ever created
+	Active      int64 `db:"active" json:"active"`             // Finished and not deleted
+	Incomplete  int64 `db:"incomplete" json:"incomplete"`     // Still being uploaded
+	Trashed     int64 `db:"trashed" json:"trashed"`           // Deleted but not yet purged
+	Purged      int64 `db:"purged" json:"purged"`             // Deleted with their files removed
+	Quarantined int64 `db:"quarantined" json:"quarantined"`   // Active and held for review
+	Identified  int64 `db:"identified" json:"identified"`     // Active and uploaded with an account
+	ActiveBytes int64 `db:"active_bytes" json:"active_bytes"` // Size of active uploads, counting duplicates
+	Downloads   int64 `db:"downloads" json:"downloads"`
+	BytesServed int64 `db:"bytes_served" json:"bytes_served"`
+
+	// counted from the files under complete/, where duplicate uploads share a file
+	StoredFiles int64 `db:"-" json:"stored_files"`
+	StoredBytes int64 `db:"-" json:"stored_bytes"`
+
+	Types []TypeStats `db:"-" json:"types"` // Active uploads by file type, largest first
+}
+
+// TypeStats summarises the active uploads of a file type
+type TypeStats struct {
+	Filetype string `db:"filetype" json:"filetype"`
+	Uploads  int64  `db:"uploads" json:"uploads"`
+	Bytes    int64  `db:"bytes" json:"bytes"`
+}
+
+// Stats counts the uploads in the database and the files in storage
+func (store *ShardedFileStore) Stats() (stats Stats, err error) {
+	err = store.DBConn.DB.Get(&stats, `
+		SELECT
+			COUNT(*) AS uploads,
+			COALESCE(SUM(CASE WHEN deleted = 0 AND sha256sum IS NOT NULL THEN 1 ELSE 0 END), 0) AS active,
+			COALESCE(SUM(CASE WHEN deleted = 0 AND sha256sum IS NULL THEN 1 ELSE 0 END), 0) AS incomplete,
+			COALESCE(SUM(CASE WHEN deleted = 1 AND purged = 0 THEN 1 ELSE 0 END), 0) AS trashed,
+			COALESCE(SUM(CASE WHEN purged = 1 THEN 1 ELSE 0 END), 0) AS purged,
+			COALESCE(SUM(CASE WHEN deleted = 0 AND quarantined = 1 THEN 1 ELSE 0 END), 0) AS quarantined,
+			COALESCE(SUM(CASE WHEN deleted = 0 AND jwt_account != '' THEN 1 ELSE 0 END), 0) AS identified,
+			COALESCE(SUM(CASE WHEN deleted = 0 AND sha256sum IS NOT NULL THEN size ELSE 0 END), 0) AS active_bytes,
+			COALESCE(SUM(download_count), 0) AS downloads,
+			COALESCE(SUM(bytes_served), 0) AS bytes_served
+		FROM uploads
+	`)
+	if err != nil {
+		return
+	}
+
+	stats.Types = make([]TypeStats, 0)
+	err = store.DBConn.DB.Select(&stats.Types, `
+		SELECT
+			COALESCE(filetype, '') AS filetype,
+			COUNT(*) AS uploads,
+			COALESCE(SUM(size), 0) AS bytes
+		FROM uploads
+		WHERE deleted = 0 AND sha256sum IS NOT NULL
+		GROUP BY filetype
+		ORDER BY bytes DESC
+	`)
+	if err != nil {
+		return
+	}
+
+	err = filepath.Walk(filepath.Join(store.BasePath, "complete"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(path, ".bin") {
+			stats.StoredFiles++
+			stats.StoredBytes += info.Size()
+		}
+		return nil
+	})
+	return
+}
+
+// StorageBytes sums the size of the uploads whose files are in storage,
+// counting every upload (logical) or each file once (deduplicated)
+func (store *ShardedFileStore) StorageBytes() (logical, deduplicated int64, err error) {
+	err = store.DBConn.DB.QueryRow(`
+		SELECT COALESCE(SUM(size), 0)
+		FROM uploads
+		WHERE purged = 0 AND sha256sum IS NOT NULL
+	`).Scan(&logical)
+	if err != nil {
+		return
+	}
+
+	err = store.DBConn.DB.QueryRow(`
+		SELECT COALESCE(SUM(size), 0)
+		FROM (
+			SELECT MAX(size) AS size
+			FROM uploads
+			WHERE purged = 0 AND sha256sum IS NOT NULL
+			GROUP BY sha256sum
+		) blobs
+	`).Scan(&deduplicated)
+	return
+}